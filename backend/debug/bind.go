@@ -4,7 +4,11 @@ import "github.com/jsimonetti/ldapserv/ldap"
 
 func (d *DebugBackend) Bind(w ldap.ResponseWriter, m *ldap.Message) {
 	r := m.GetBindRequest()
-	dump(r)
+	// the credentials are left out
+	dump(struct {
+		Name                 string
+		AuthenticationChoice string
+	}{string(r.Name()), r.AuthenticationChoice()})
 	res := ldap.NewBindResponse(ldap.LDAPResultUnwillingToPerform)
 	w.Write(res)
 }
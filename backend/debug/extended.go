@@ -4,7 +4,12 @@ import "github.com/jsimonetti/ldapserv/ldap"
 
 func (d *DebugBackend) Extended(w ldap.ResponseWriter, m *ldap.Message) {
 	r := m.GetExtendedRequest()
-	dump(r)
+	if r.RequestName() == ldap.NoticeOfPasswordModify {
+		// the passwords are left out
+		dump(r.RequestName())
+	} else {
+		dump(r)
+	}
 	res := ldap.NewExtendedResponse(ldap.LDAPResultSuccess)
 	w.Write(res)
 }
@@ -1,10 +1,17 @@
 package debug
 
-import "github.com/jsimonetti/ldapserv/ldap"
+import (
+	"github.com/jsimonetti/ldapserv/filter"
+	"github.com/jsimonetti/ldapserv/ldap"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
 
 func (d *DebugBackend) Search(w ldap.ResponseWriter, m *ldap.Message) {
 	r := m.GetSearchRequest()
 	dump(r)
+	if f, err := filter.Decompile(r.Filter()); err == nil {
+		d.Log.Debug("Search", log.Ctx{"filter": f})
+	}
 	res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultSuccess)
 	w.Write(res)
 }
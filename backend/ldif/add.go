@@ -2,10 +2,10 @@ package ldif
 
 import (
 	"encoding/base64"
-	"fmt"
 	"os"
 	"strconv"
 
+	"github.com/jsimonetti/ldapserv/dn"
 	"github.com/jsimonetti/ldapserv/ldap"
 	log "gopkg.in/inconshreveable/log15.v2"
 )
@@ -13,22 +13,25 @@ import (
 func (l *LdifBackend) Add(w ldap.ResponseWriter, m *ldap.Message) {
 	r := m.GetAddRequest()
 	// Handle Stop Signal (server stop / client disconnected / Abandoned request....)
-	select {
-	case <-m.Done:
+	if m.Context().Err() != nil {
 		l.Log.Debug("Leaving Add... stop signal")
 		return
-	default:
 	}
 
 	l.Log.Debug("Adding entry", log.Ctx{"entry": r.Entry()})
 
-	entry := ldif{dn: string(r.Entry())}
+	name, err := dn.Parse(string(r.Entry()))
+	if err != nil || len(name) == 0 {
+		w.Write(ldap.NewAddResponse(ldap.LDAPResultInvalidDNSyntax))
+		return
+	}
+	entry := ldif{dn: string(r.Entry()), name: name, file: l.entryFile(name)}
 
 	for _, attribute := range r.Attributes() {
 		for _, attributeValue := range attribute.Vals() {
 			if isValueBinary([]byte(attributeValue)) {
 				value := base64.StdEncoding.EncodeToString([]byte(attributeValue))
-				entry.attr = append(entry.attr, attr{name: string(attribute.Type_()), content: []byte(value), atype: ATTR_TYPE_BINARY})
+				entry.attr = append(entry.attr, attr{name: string(attribute.Type_()), content: []byte(attributeValue), atype: ATTR_TYPE_BINARY})
 				l.Log.Debug("attribute", log.Ctx{"type": attribute.Type_(), "value": string(value), "atype": "binary"})
 			} else {
 				entry.attr = append(entry.attr, attr{name: string(attribute.Type_()), content: []byte(attributeValue), atype: ATTR_TYPE_TEXT})
@@ -36,8 +39,13 @@ func (l *LdifBackend) Add(w ldap.ResponseWriter, m *ldap.Message) {
 			}
 		}
 	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.findEntry(name) != nil {
+		w.Write(ldap.NewAddResponse(ldap.LDAPResultEntryAlreadyExists))
+		return
+	}
 	if ok, err := l.saveEntry(entry); ok {
-		l.ldifs = append(l.ldifs, entry)
 		res := ldap.NewAddResponse(ldap.LDAPResultSuccess)
 		w.Write(res)
 		return
@@ -49,21 +57,14 @@ func (l *LdifBackend) Add(w ldap.ResponseWriter, m *ldap.Message) {
 }
 
 func (l *LdifBackend) saveEntry(entry ldif) (bool, error) {
-
-	fname := l.Path + "/" + entry.dn + ".ldif"
-	if _, err := os.Stat(fname); err == nil {
+	if _, err := os.Stat(entry.file); err == nil {
 		return false, os.ErrExist
 	}
 
-	f, _ := os.Create(fname)
-	f.Write([]byte(fmt.Sprintf("dn: %s\n", entry.dn)))
-
-	for _, attr := range entry.attr {
-		if attr.atype == ATTR_TYPE_TEXT {
-			f.Write([]byte(fmt.Sprintf("%s: %s\n", attr.name, string(attr.content))))
-		} else {
-			f.Write([]byte(fmt.Sprintf("%s:: %s\n", attr.name, string(attr.content))))
-		}
+	l.ldifs = append(l.ldifs, entry)
+	if err := l.writeLdif(entry.file); err != nil {
+		l.ldifs = l.ldifs[:len(l.ldifs)-1]
+		return false, err
 	}
 	return true, nil
 }
@@ -1,6 +1,9 @@
 package ldif
 
 import (
+	"strings"
+
+	"github.com/jsimonetti/ldapserv/dn"
 	"github.com/jsimonetti/ldapserv/ldap"
 	log "gopkg.in/inconshreveable/log15.v2"
 )
@@ -10,20 +13,27 @@ func (l *LdifBackend) Bind(w ldap.ResponseWriter, m *ldap.Message) {
 	res := ldap.NewBindResponse(ldap.LDAPResultInvalidCredentials)
 
 	l.Log.Debug("Bind", log.Ctx{"authchoice": r.AuthenticationChoice(), "user": r.Name()})
+	if r.AuthenticationChoice() == "sasl" {
+		ldap.HandleSASLBind(w, m, l)
+		return
+	}
 	if r.AuthenticationChoice() == "simple" {
+		l.mutex.RLock()
+		defer l.mutex.RUnlock()
 		//search for userdn
+		name, err := dn.Parse(string(r.Name()))
 		for _, ldif := range l.ldifs {
-			if ldif.dn == string(r.Name()) {
+			if err == nil && ldif.name.Equal(name) {
 				//Check password
 				for _, attr := range ldif.attr {
 
-					if attr.name == "userPassword" {
-						if string(attr.content) == string(r.AuthenticationSimple()) {
+					if sameAttributeType(attr.name, "userPassword") {
+						if ldap.CheckPassword(attr.content, []byte(r.AuthenticationSimple())) {
 							res.SetResultCode(ldap.LDAPResultSuccess)
 							w.Write(res)
 							return
 						}
-						l.Log.Debug("userPassword doesn't match", log.Ctx{"pass": r.Authentication(), "userPassword": attr.content})
+						l.Log.Debug("userPassword doesn't match", log.Ctx{"user": r.Name()})
 						break
 					}
 				}
@@ -31,7 +41,7 @@ func (l *LdifBackend) Bind(w ldap.ResponseWriter, m *ldap.Message) {
 				break
 			}
 		}
-		l.Log.Info("Bind failed", log.Ctx{"user": r.Name(), "pass": r.Authentication()})
+		l.Log.Info("Bind failed", log.Ctx{"user": r.Name()})
 		res.SetResultCode(ldap.LDAPResultInvalidCredentials)
 		res.SetDiagnosticMessage("invalid credentials")
 	} else {
@@ -40,3 +50,47 @@ func (l *LdifBackend) Bind(w ldap.ResponseWriter, m *ldap.Message) {
 	}
 	w.Write(res)
 }
+
+// LookupUser maps a SASL authentication identity, either a DN, a "dn:" or
+// "u:" prefixed identity or a bare uid or cn, to its entry
+func (l *LdifBackend) LookupUser(authcid string) (string, [][]byte, bool) {
+	byDN := strings.Contains(authcid, "=")
+	switch {
+	case strings.HasPrefix(authcid, "dn:"):
+		authcid, byDN = authcid[3:], true
+	case strings.HasPrefix(authcid, "u:"):
+		authcid, byDN = authcid[2:], false
+	}
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	for i := range l.ldifs {
+		entry := &l.ldifs[i]
+		if byDN {
+			if !sameDN(entry.dn, authcid) {
+				continue
+			}
+		} else if !containsFold(entry.AttributeValues("uid"), authcid) && !containsFold(entry.AttributeValues("cn"), authcid) {
+			continue
+		}
+
+		var passwords [][]byte
+		for _, a := range entry.attr {
+			if sameAttributeType(a.name, "userPassword") {
+				passwords = append(passwords, a.content)
+			}
+		}
+		return entry.dn, passwords, true
+	}
+	return "", nil, false
+}
+
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+package ldif
+
+import (
+	"strings"
+
+	"github.com/jsimonetti/ldapserv/dn"
+)
+
+// sameDN returns true when a and b are valid DNs naming the same entry
+func sameDN(a, b string) bool {
+	da, err := dn.Parse(a)
+	if err != nil {
+		return false
+	}
+	db, err := dn.Parse(b)
+	return err == nil && da.Equal(db)
+}
+
+// findEntry returns the entry named name
+func (l *LdifBackend) findEntry(name dn.DN) *ldif {
+	for i := range l.ldifs {
+		if l.ldifs[i].name.Equal(name) {
+			return &l.ldifs[i]
+		}
+	}
+	return nil
+}
+
+// entryFile returns the .ldif file named after an entry, the slashes of
+// the DN are hex escaped to keep the file in the backend directory
+func (l *LdifBackend) entryFile(name dn.DN) string {
+	return l.Path + "/" + strings.Replace(name.String(), "/", `\2f`, -1) + ".ldif"
+}
@@ -7,6 +7,10 @@ import (
 
 func (l *LdifBackend) Extended(w ldap.ResponseWriter, m *ldap.Message) {
 	r := m.GetExtendedRequest()
+	if r.RequestName() == ldap.NoticeOfPasswordModify {
+		l.passwordModify(w, m)
+		return
+	}
 	l.Log.Debug("Extended request received", log.Ctx{"name": r.RequestName(), "value": r.RequestValue()})
 	res := ldap.NewExtendedResponse(ldap.LDAPResultSuccess)
 	w.Write(res)
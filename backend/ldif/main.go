@@ -1,10 +1,58 @@
 package ldif
 
-import log "gopkg.in/inconshreveable/log15.v2"
+import (
+	"sync"
+
+	"github.com/jsimonetti/ldapserv/dn"
+	"github.com/jsimonetti/ldapserv/ldap"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
 
 type ldif struct {
-	dn   string
+	dn string
+	// name is the parsed dn, used to compare the entry DN
+	name dn.DN
 	attr []attr
+	// file is the .ldif file the entry is stored in
+	file string
+}
+
+// DN returns the distinguished name of the entry
+func (l *ldif) DN() string {
+	return l.dn
+}
+
+// AttributeValues returns the values of the attribute name, given by any
+// of the names or the OID of its type
+func (l *ldif) AttributeValues(name string) []string {
+	var values []string
+	for _, a := range l.attr {
+		if sameAttributeType(a.name, name) {
+			values = append(values, string(a.content))
+		}
+	}
+	return values
+}
+
+// AttributeTypes returns the types of the attributes of the entry
+func (l *ldif) AttributeTypes() []string {
+	var types []string
+	seen := make(map[string]bool)
+	for _, a := range l.attr {
+		if name, _, _ := dn.LookupAttribute(a.name); !seen[name] {
+			seen[name] = true
+			types = append(types, a.name)
+		}
+	}
+	return types
+}
+
+// sameAttributeType returns true when both names are the ones of the same
+// attribute type, see dn.RegisterAttribute
+func sameAttributeType(a, b string) bool {
+	ta, _, _ := dn.LookupAttribute(a)
+	tb, _, _ := dn.LookupAttribute(b)
+	return ta == tb
 }
 
 type attr struct {
@@ -20,6 +68,15 @@ const (
 
 type LdifBackend struct {
 	ldifs []ldif
+	mutex sync.RWMutex
 	Path  string
 	Log   log.Logger
+	// PasswordScheme is the scheme used to store the passwords changed by
+	// a Password Modify extended operation, ie "{SSHA}"
+	PasswordScheme string
+	// Admins are the DNs allowed to change the password of other users
+	Admins []string
+	// Metrics, if non-nil, receives the number of entries held and
+	// returned by searches
+	Metrics *ldap.Metrics
 }
@@ -1,10 +1,217 @@
 package ldif
 
-import "github.com/jsimonetti/ldapserv/ldap"
+import (
+	"os"
 
+	"github.com/jsimonetti/ldapserv/dn"
+	"github.com/jsimonetti/ldapserv/ldap"
+	"github.com/lor00x/goldap/message"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// renamedEntry is an entry moved by a ModifyDN request along with its
+// previous state
+type renamedEntry struct {
+	entry *ldif
+	name  dn.DN
+	file  string
+	old   ldif
+}
+
+// ModifyDN renames an entry and moves it with its whole subtree when the
+// request has a new superior. The .ldif files named after the entries are
+// renamed accordingly.
 func (l *LdifBackend) ModifyDN(w ldap.ResponseWriter, m *ldap.Message) {
-	//r := m.GetModifyDNRequest()
-	l.Log.Debug("ModifyDN entry")
-	res := ldap.NewModifyResponse(ldap.LDAPResultSuccess)
-	w.Write(res)
+	req, err := ldap.ParseModifyDNRequest(m)
+	if err != nil {
+		w.Write(modifyDNResponse(ldap.LDAPResultProtocolError, err.Error()))
+		return
+	}
+	l.Log.Debug("ModifyDN entry", log.Ctx{"entry": req.Entry, "newrdn": req.NewRDN, "deleteoldrdn": req.DeleteOldRDN, "newsuperior": req.NewSuperior})
+
+	name, err := dn.Parse(req.Entry)
+	if err != nil {
+		w.Write(modifyDNResponse(ldap.LDAPResultInvalidDNSyntax, "invalid entry DN"))
+		return
+	}
+	newRDN, err := dn.ParseRDN(req.NewRDN)
+	if err != nil {
+		w.Write(modifyDNResponse(ldap.LDAPResultInvalidDNSyntax, "invalid new RDN"))
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	entry := l.findEntry(name)
+	if entry == nil {
+		w.Write(modifyDNResponse(ldap.LDAPResultNoSuchObject, "no such entry"))
+		return
+	}
+
+	parent := entry.name.Parent()
+	if req.NewSuperior != nil {
+		if parent, err = dn.Parse(*req.NewSuperior); err != nil {
+			w.Write(modifyDNResponse(ldap.LDAPResultInvalidDNSyntax, "invalid new superior"))
+			return
+		}
+		if len(parent) > 0 && l.findEntry(parent) == nil {
+			w.Write(modifyDNResponse(ldap.LDAPResultNoSuchObject, "new superior does not exist"))
+			return
+		}
+		if len(parent) > 0 && parent.InSubtree(entry.name) {
+			w.Write(modifyDNResponse(ldap.LDAPResultUnwillingToPerform, "can not move an entry below itself"))
+			return
+		}
+	}
+	newDN := parent.Child(newRDN)
+	if existing := l.findEntry(newDN); existing != nil && existing != entry {
+		w.Write(modifyDNResponse(ldap.LDAPResultEntryAlreadyExists, "entry already exists"))
+		return
+	}
+
+	renames := l.subtreeRenames(entry, newDN)
+	oldFiles := make(map[string]bool)
+	for _, r := range renames {
+		oldFiles[r.old.file] = true
+	}
+	for _, r := range renames {
+		if oldFiles[r.file] {
+			continue
+		}
+		if _, err := os.Stat(r.file); err == nil {
+			w.Write(modifyDNResponse(ldap.LDAPResultEntryAlreadyExists, "entry already exists"))
+			return
+		}
+	}
+
+	for _, r := range renames {
+		r.entry.dn = r.name.String()
+		r.entry.name = r.name
+		r.entry.file = r.file
+	}
+	entry.attr = renameAttributes(renames[0].old, newRDN, req.DeleteOldRDN)
+
+	if err := l.writeRenames(renames); err != nil {
+		l.Log.Error("ModifyDN error", log.Ctx{"entry": req.Entry, "error": err})
+		w.Write(modifyDNResponse(ldap.LDAPResultOperationsError, "unable to save the entries"))
+		return
+	}
+	l.Log.Info("entry renamed", log.Ctx{"entry": req.Entry, "newdn": newDN.String(), "entries": len(renames)})
+	w.Write(ldap.NewModifyDNResponse(ldap.LDAPResultSuccess))
+}
+
+// subtreeRenames returns the new DN and file of the entry and its
+// descendants, the entry comes first
+func (l *LdifBackend) subtreeRenames(entry *ldif, newDN dn.DN) []renamedEntry {
+	renames := []renamedEntry{{entry: entry, name: newDN, file: l.renamedFile(entry, newDN), old: *entry}}
+	for i := range l.ldifs {
+		e := &l.ldifs[i]
+		if e == entry {
+			continue
+		}
+		if name, ok := e.name.Rebase(entry.name, newDN); ok {
+			renames = append(renames, renamedEntry{entry: e, name: name, file: l.renamedFile(e, name), old: *e})
+		}
+	}
+	return renames
+}
+
+// renamedFile returns the file of an entry once renamed: files named after
+// the entry follow it, files holding several entries are kept
+func (l *LdifBackend) renamedFile(e *ldif, name dn.DN) string {
+	if e.file == l.entryFile(e.name) || e.file == l.Path+"/"+e.dn+".ldif" {
+		return l.entryFile(name)
+	}
+	return e.file
+}
+
+// writeRenames writes the files of the renamed entries and removes the
+// files left empty, the entries are restored when a file can not be written
+func (l *LdifBackend) writeRenames(renames []renamedEntry) error {
+	files := make(map[string]bool)
+	for _, r := range renames {
+		files[r.file] = true
+	}
+
+	var written []string
+	for file := range files {
+		if err := l.writeLdif(file); err != nil {
+			for _, r := range renames {
+				*r.entry = r.old
+			}
+			for _, file := range written {
+				os.Remove(file)
+			}
+			for _, r := range renames {
+				if files[r.old.file] {
+					l.writeLdif(r.old.file)
+				}
+			}
+			return err
+		}
+		written = append(written, file)
+	}
+
+	for _, r := range renames {
+		if !files[r.old.file] {
+			os.Remove(r.old.file)
+		}
+	}
+	return nil
+}
+
+// renameAttributes returns the attributes of the entry once its RDN
+// changed: the values of the new RDN are added and the values of the old
+// RDN removed when deleteOldRDN is set
+func renameAttributes(entry ldif, newRDN dn.RDN, deleteOldRDN bool) []attr {
+	attrs := append([]attr{}, entry.attr...)
+	if deleteOldRDN {
+		for _, av := range entry.name.RDN() {
+			if containsValue(newRDN, av) {
+				continue
+			}
+			kept := attrs[:0:0]
+			for _, a := range attrs {
+				if !matchesValue(a, av) {
+					kept = append(kept, a)
+				}
+			}
+			attrs = kept
+		}
+	}
+	for _, av := range newRDN {
+		found := false
+		for _, a := range attrs {
+			if matchesValue(a, av) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			attrs = append(attrs, attr{name: av.Type, content: []byte(av.Value), atype: ATTR_TYPE_TEXT})
+		}
+	}
+	return attrs
+}
+
+func containsValue(rdn dn.RDN, av dn.AttributeTypeAndValue) bool {
+	for _, v := range rdn {
+		if v.Normalize() == av.Normalize() {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesValue returns true when the attribute holds the value of the
+// assertion, according to the equality rule of the attribute type
+func matchesValue(a attr, av dn.AttributeTypeAndValue) bool {
+	return dn.AttributeTypeAndValue{Type: a.name, Value: string(a.content)}.Normalize() == av.Normalize()
+}
+
+func modifyDNResponse(resultCode int, diagnosticMessage string) message.ModifyDNResponse {
+	res := ldap.NewResponse(resultCode)
+	res.SetDiagnosticMessage(diagnosticMessage)
+	return message.ModifyDNResponse(res)
 }
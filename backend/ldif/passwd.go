@@ -0,0 +1,142 @@
+package ldif
+
+import (
+	"strings"
+
+	"github.com/jsimonetti/ldapserv/ldap"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// passwordModify changes the userPassword of an entry, users can change
+// their own password and admins the password of any user
+// @see RFC https://tools.ietf.org/html/rfc3062
+func (l *LdifBackend) passwordModify(w ldap.ResponseWriter, m *ldap.Message) {
+	req, err := ldap.ParsePasswordModifyRequest(m)
+	if err != nil {
+		l.Log.Debug("invalid password modify request", log.Ctx{"error": err})
+		res := ldap.NewPasswordModifyResponse(ldap.LDAPResultProtocolError, nil)
+		res.SetDiagnosticMessage("invalid password modify request")
+		w.Write(res)
+		return
+	}
+
+	bindDN := m.Client.BindDN()
+	identity := string(req.UserIdentity)
+	if req.UserIdentity == nil {
+		identity = bindDN
+	}
+	if identity == "" {
+		res := ldap.NewPasswordModifyResponse(ldap.LDAPResultUnwillingToPerform, nil)
+		res.SetDiagnosticMessage("an anonymous session has no password to change")
+		w.Write(res)
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	entry := l.findUser(identity)
+	if entry == nil {
+		res := ldap.NewPasswordModifyResponse(ldap.LDAPResultNoSuchObject, nil)
+		res.SetDiagnosticMessage("no such user")
+		w.Write(res)
+		return
+	}
+	if !sameDN(entry.dn, bindDN) && !l.isAdmin(bindDN) {
+		l.Log.Info("password modify denied", log.Ctx{"user": entry.dn, "binddn": bindDN})
+		res := ldap.NewPasswordModifyResponse(ldap.LDAPResultInsufficientAccessRights, nil)
+		res.SetDiagnosticMessage("not allowed to change the password of this user")
+		w.Write(res)
+		return
+	}
+
+	if req.OldPassword != nil && !entry.checkPassword(req.OldPassword) {
+		res := ldap.NewPasswordModifyResponse(ldap.LDAPResultInvalidCredentials, nil)
+		res.SetDiagnosticMessage("invalid old password")
+		w.Write(res)
+		return
+	}
+
+	var generated []byte
+	password := req.NewPassword
+	if password == nil {
+		if generated, err = ldap.GeneratePassword(); err != nil {
+			l.Log.Error("unable to generate a password", log.Ctx{"error": err})
+			w.Write(ldap.NewPasswordModifyResponse(ldap.LDAPResultOther, nil))
+			return
+		}
+		password = generated
+	}
+
+	hashed, err := ldap.HashPassword(l.PasswordScheme, password)
+	if err != nil {
+		l.Log.Error("unable to hash the password", log.Ctx{"scheme": l.PasswordScheme, "error": err})
+		w.Write(ldap.NewPasswordModifyResponse(ldap.LDAPResultOther, nil))
+		return
+	}
+
+	previous := entry.attr
+	entry.setPassword(hashed)
+	if err := l.writeLdif(entry.file); err != nil {
+		entry.attr = previous
+		l.Log.Error("unable to save the password", log.Ctx{"user": entry.dn, "error": err})
+		w.Write(ldap.NewPasswordModifyResponse(ldap.LDAPResultOperationsError, nil))
+		return
+	}
+
+	l.Log.Info("password changed", log.Ctx{"user": entry.dn, "binddn": bindDN})
+	w.Write(ldap.NewPasswordModifyResponse(ldap.LDAPResultSuccess, generated))
+}
+
+// findUser returns the entry of a user identity: a DN or an authzId
+func (l *LdifBackend) findUser(identity string) *ldif {
+	byDN := true
+	switch {
+	case strings.HasPrefix(identity, "dn:"):
+		identity = identity[3:]
+	case strings.HasPrefix(identity, "u:"):
+		identity, byDN = identity[2:], false
+	}
+	for i := range l.ldifs {
+		entry := &l.ldifs[i]
+		if byDN && sameDN(entry.dn, identity) {
+			return entry
+		}
+		if !byDN && containsFold(entry.AttributeValues("uid"), identity) {
+			return entry
+		}
+	}
+	return nil
+}
+
+func (l *LdifBackend) isAdmin(dn string) bool {
+	if dn == "" {
+		return false
+	}
+	for _, admin := range l.Admins {
+		if sameDN(admin, dn) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *ldif) checkPassword(password []byte) bool {
+	for _, a := range l.attr {
+		if sameAttributeType(a.name, "userPassword") && ldap.CheckPassword(a.content, password) {
+			return true
+		}
+	}
+	return false
+}
+
+// setPassword replaces the userPassword values of the entry
+func (l *ldif) setPassword(password []byte) {
+	attrs := make([]attr, 0, len(l.attr)+1)
+	for _, a := range l.attr {
+		if !sameAttributeType(a.name, "userPassword") {
+			attrs = append(attrs, a)
+		}
+	}
+	l.attr = append(attrs, attr{name: "userPassword", content: password, atype: ATTR_TYPE_TEXT})
+}
@@ -1,8 +1,10 @@
 package ldif
 
 import (
-	"strings"
+	"context"
 
+	"github.com/jsimonetti/ldapserv/dn"
+	"github.com/jsimonetti/ldapserv/filter"
 	"github.com/jsimonetti/ldapserv/ldap"
 	"github.com/lor00x/goldap/message"
 	log "gopkg.in/inconshreveable/log15.v2"
@@ -11,52 +13,105 @@ import (
 func (l *LdifBackend) Search(w ldap.ResponseWriter, m *ldap.Message) {
 	r := m.GetSearchRequest()
 	// Handle Stop Signal (server stop / client disconnected / Abandoned request....)
-	select {
-	case <-m.Done:
+	if m.Context().Err() != nil {
 		l.Log.Debug("Leaving Search... stop signal")
 		return
-	default:
-	}
-
-	l.Log.Debug("Search", log.Ctx{"basedn": r.BaseObject(), "filter": r.Filter(), "filterString": r.FilterString(), "attributes": r.Attributes(), "timeLimit": r.TimeLimit().Int()})
-
-	var entries []message.SearchResultEntry
-
-	for _, ldif := range l.ldifs {
-		if strings.ToLower(ldif.dn) == strings.ToLower(string(r.BaseObject())) {
-			if m, result := matchesFilter(r.Filter(), ldif); m != true {
-				if result != ldap.LDAPResultSuccess {
-					res := ldap.NewSearchResultDoneResponse(result)
-					w.Write(res)
-					//return make([]message.SearchResultEntry, 0), result
-					return
-				}
-				continue
-			}
-			entry := l.formatEntry(&ldif, r.Attributes())
-			entries = append(entries, entry)
+	}
+
+	filterString, _ := filter.Decompile(r.Filter())
+	l.Log.Debug("Search", log.Ctx{"basedn": r.BaseObject(), "filter": r.Filter(), "filterString": filterString, "attributes": r.Attributes(), "timeLimit": r.TimeLimit().Int()})
+
+	// paged results and virtual list view are mutually exclusive, the
+	// virtual list view already limits the number of entries returned
+	_, vlv := m.GetControl(ldap.ControlTypeVLVRequest)
+
+	var result int
+	if _, ok := m.GetControl(ldap.ControlTypePaging); ok && !vlv {
+		result = ldap.WritePagedResults(w, m, func() ([]message.SearchResultEntry, int) {
+			return l.search(w, m)
+		})
+	} else {
+		var entries []message.SearchResultEntry
+		entries, result = l.search(w, m)
+		for i := 0; i < len(entries) && m.Context().Err() == nil; i++ {
+			w.Write(entries[i])
+		}
+	}
+
+	// an abandoned or canceled search is not answered, a search over its
+	// time limit ends with the entries already sent
+	switch m.Context().Err() {
+	case context.Canceled:
+		l.Log.Debug("Leaving Search... stop signal")
+		return
+	case context.DeadlineExceeded:
+		result = ldap.LDAPResultTimeLimitExceeded
+	}
+
+	res := ldap.NewSearchResultDoneResponse(result)
+	w.Write(res)
+}
+
+// search returns the entries matching the search request, sorted when
+// the request holds a sort control and limited to the requested window
+// when it holds a virtual list view control. The entries over the size
+// limit of the request are dropped and the search ends with
+// sizeLimitExceeded.
+func (l *LdifBackend) search(w ldap.ResponseWriter, m *ldap.Message) ([]message.SearchResultEntry, int) {
+	r := m.GetSearchRequest()
+	var found []ldap.Entry
+
+	base, err := dn.Parse(string(r.BaseObject()))
+	if err != nil {
+		return nil, ldap.LDAPResultInvalidDNSyntax
+	}
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	for i := range l.ldifs {
+		if m.Context().Err() != nil {
+			return nil, ldap.LDAPResultSuccess
+		}
+		ldif := &l.ldifs[i]
+		if !inScope(ldif.name, base, int(r.Scope())) {
 			continue
 		}
-		if strings.HasSuffix(strings.ToLower(ldif.dn), strings.ToLower(string(r.BaseObject()))) {
-			if m, result := matchesFilter(r.Filter(), ldif); m != true {
-				if result != ldap.LDAPResultSuccess {
-					res := ldap.NewSearchResultDoneResponse(result)
-					w.Write(res)
-					//return make([]message.SearchResultEntry, 0), result
-					return
-				}
-				continue
-			}
-			entry := l.formatEntry(&ldif, r.Attributes())
-			entries = append(entries, entry)
+		if filter.Evaluate(r.Filter(), ldif) != filter.True {
 			continue
 		}
+		found = append(found, ldif)
+	}
+
+	if result := ldap.SortEntries(w, m, found); result != ldap.LDAPResultSuccess {
+		return nil, result
+	}
+	found, result := ldap.VirtualListView(w, m, found)
+	if result != ldap.LDAPResultSuccess {
+		return nil, result
 	}
 
-	for i := 0; i < len(entries); i++ {
-		w.Write(entries[i])
+	result = ldap.LDAPResultSuccess
+	if limit := r.SizeLimit().Int(); limit > 0 && len(found) > limit {
+		found, result = found[:limit], ldap.LDAPResultSizeLimitExceeded
 	}
 
-	res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultSuccess)
-	w.Write(res)
+	entries := make([]message.SearchResultEntry, 0, len(found))
+	for _, e := range found {
+		entries = append(entries, l.formatEntry(e.(*ldif), r.Attributes()))
+	}
+	l.Metrics.Counter("ldap_backend_search_entries_total", "Number of entries found by searches.", "backend", "ldif").Add(float64(len(entries)))
+	return entries, result
+}
+
+// inScope returns true when the entry name is in the scope of a search
+// from base
+func inScope(name, base dn.DN, scope int) bool {
+	switch scope {
+	case ldap.SearchRequestScopeBaseObject:
+		return name.Equal(base)
+	case ldap.SearchRequestSingleLevel:
+		return len(name) > 0 && name.Parent().Equal(base)
+	}
+	return name.InSubtree(base)
 }
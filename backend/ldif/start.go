@@ -12,5 +12,10 @@ func (l *LdifBackend) Start() error {
 			return err
 		}
 	}
+	l.Metrics.GaugeFunc("ldap_backend_entries", "Number of entries held by the backend.", func() float64 {
+		l.mutex.RLock()
+		defer l.mutex.RUnlock()
+		return float64(len(l.ldifs))
+	}, "backend", "ldif")
 	return nil
 }
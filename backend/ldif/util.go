@@ -3,13 +3,19 @@ package ldif
 import (
 	"bufio"
 	"encoding/base64"
+	"fmt"
 	"os"
 	"strings"
 
+	"github.com/jsimonetti/ldapserv/dn"
 	"github.com/jsimonetti/ldapserv/ldap"
 	"github.com/lor00x/goldap/message"
 )
 
+// readLdif loads the entries of the file name. The folded lines are
+// joined, the comments skipped and the values given with "::" base64
+// decoded.
+// @see RFC https://tools.ietf.org/html/rfc2849
 func (l *LdifBackend) readLdif(name string) error {
 	file, err := os.Open(name)
 	if err != nil {
@@ -17,44 +23,138 @@ func (l *LdifBackend) readLdif(name string) error {
 	}
 	defer file.Close()
 
-	dn := ""
-
+	var lines []string
 	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.HasPrefix(line, " ") && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
 
+	entryDN := ""
 	attrs := make([]attr, 0)
-	for scanner.Scan() {
-		parts := strings.Split(scanner.Text(), ":")
+	for _, line := range lines {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
 		if len(parts) < 2 {
 			continue
 		}
-		if parts[0] == "dn" {
-			if dn != "" {
-				l.ldifs = append(l.ldifs, ldif{dn, attrs})
+		content, binary, err := ldifValue(parts[1])
+		if err != nil {
+			return fmt.Errorf("%s: invalid value of %s: %s", name, parts[0], err)
+		}
+		if strings.EqualFold(parts[0], "dn") {
+			if entryDN != "" {
+				if err := l.loadEntry(entryDN, attrs, name); err != nil {
+					return err
+				}
 			}
 			attrs = make([]attr, 0)
-			dn = strings.TrimSpace(parts[1])
+			entryDN = string(content)
+			continue
+		}
+		atype := ATTR_TYPE_TEXT
+		if binary {
+			atype = ATTR_TYPE_BINARY
+		}
+		attrs = append(attrs, attr{parts[0], content, atype})
+	}
+	return l.loadEntry(entryDN, attrs, name)
+}
+
+// ldifValue decodes what follows the first colon of a line, the value is
+// base64 encoded when it starts with a second colon. It returns true for
+// the binary values.
+func ldifValue(v string) ([]byte, bool, error) {
+	if !strings.HasPrefix(v, ":") {
+		return []byte(strings.TrimSpace(v)), false, nil
+	}
+	content, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v[1:]))
+	if err != nil {
+		return nil, false, err
+	}
+	return content, isValueBinary(content), nil
+}
+
+// isSafeString returns true for the text values which can be written as
+// is, the others are base64 encoded
+func isSafeString(v string) bool {
+	if v == "" {
+		return true
+	}
+	switch v[0] {
+	case ' ', ':', '<':
+		return false
+	}
+	return v[len(v)-1] != ' ' && !strings.ContainsAny(v, "\r\n\x00")
+}
+
+// loadEntry adds an entry read from the file name
+func (l *LdifBackend) loadEntry(entryDN string, attrs []attr, name string) error {
+	parsed, err := dn.Parse(entryDN)
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	l.ldifs = append(l.ldifs, ldif{dn: entryDN, name: parsed, attr: attrs, file: name})
+	return nil
+}
+
+// writeLdif writes the entries stored in the file name, the file is
+// replaced atomically
+func (l *LdifBackend) writeLdif(name string) error {
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	first := true
+	for _, entry := range l.ldifs {
+		if entry.file != name {
+			continue
+		}
+		if !first {
+			w.WriteString("\n")
+		}
+		first = false
+		if isSafeString(entry.dn) {
+			w.WriteString(fmt.Sprintf("dn: %s\n", entry.dn))
 		} else {
-			if len(parts) == 3 {
-				val, _ := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[2]))
-				attrs = append(attrs, attr{parts[0], []byte(val), ATTR_TYPE_BINARY})
+			w.WriteString(fmt.Sprintf("dn:: %s\n", base64.StdEncoding.EncodeToString([]byte(entry.dn))))
+		}
+		for _, attr := range entry.attr {
+			if attr.atype == ATTR_TYPE_TEXT && isSafeString(string(attr.content)) {
+				w.WriteString(fmt.Sprintf("%s: %s\n", attr.name, string(attr.content)))
 			} else {
-				attrs = append(attrs, attr{parts[0], []byte(strings.TrimSpace(parts[1])), ATTR_TYPE_TEXT})
+				w.WriteString(fmt.Sprintf("%s:: %s\n", attr.name, base64.StdEncoding.EncodeToString(attr.content)))
 			}
 		}
 	}
-	l.ldifs = append(l.ldifs, ldif{dn, attrs})
-
-	if err := scanner.Err(); err != nil {
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
 		return err
 	}
-	return nil
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
 }
 
 func (l *LdifBackend) formatEntry(ldif *ldif, attributes message.AttributeSelection) message.SearchResultEntry {
 	e := ldap.NewSearchResultEntry(ldif.dn)
 	var content string
 	for _, attr := range ldif.attr {
-		if attr.name == "userPassword" {
+		if sameAttributeType(attr.name, "userPassword") {
 			continue
 		}
 		if attr.atype == ATTR_TYPE_TEXT {
@@ -67,8 +167,9 @@ func (l *LdifBackend) formatEntry(ldif *ldif, attributes message.AttributeSelect
 			continue
 		}
 		for _, wantattr := range attributes {
-			if attr.name == string(wantattr) {
+			if sameAttributeType(attr.name, string(wantattr)) {
 				e.AddAttribute(message.AttributeDescription(attr.name), message.AttributeValue(content))
+				break
 			}
 		}
 	}
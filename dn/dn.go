@@ -0,0 +1,376 @@
+// Package dn parses, formats and compares LDAP distinguished names.
+// @see RFC https://tools.ietf.org/html/rfc4514
+package dn
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// AttributeTypeAndValue is an assertion of a RDN, ie cn=admin
+type AttributeTypeAndValue struct {
+	Type  string
+	Value string
+}
+
+// RDN is a relative distinguished name, it holds several assertions when
+// multi-valued, ie cn=admin+uid=0
+type RDN []AttributeTypeAndValue
+
+// DN is a distinguished name, its RDNs go from the entry up to the top
+// level one. The DN of the root DSE is empty.
+type DN []RDN
+
+// Parse parses the string representation of a DN. The spaces around the
+// separators are ignored, the values may hold escaped characters, hex
+// escapes and be given as hex encoded BER.
+func Parse(s string) (DN, error) {
+	p := &parser{s: s}
+	p.skipSpaces()
+	if p.eof() {
+		return DN{}, nil
+	}
+	var d DN
+	for {
+		rdn, err := p.rdn()
+		if err != nil {
+			return nil, fmt.Errorf("invalid DN %q: %s", s, err)
+		}
+		d = append(d, rdn)
+		if p.eof() {
+			return d, nil
+		}
+		// rdn stops at the end or at a comma
+		p.pos++
+	}
+}
+
+// ParseRDN parses the string representation of a RDN
+func ParseRDN(s string) (RDN, error) {
+	d, err := Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(d) != 1 {
+		return nil, fmt.Errorf("invalid RDN %q", s)
+	}
+	return d[0], nil
+}
+
+// String returns the RFC 4514 representation of the DN
+func (d DN) String() string {
+	rdns := make([]string, len(d))
+	for i, rdn := range d {
+		rdns[i] = rdn.String()
+	}
+	return strings.Join(rdns, ",")
+}
+
+// String returns the RFC 4514 representation of the RDN
+func (r RDN) String() string {
+	avas := make([]string, len(r))
+	for i, ava := range r {
+		avas[i] = ava.String()
+	}
+	return strings.Join(avas, "+")
+}
+
+// String returns the RFC 4514 representation of the assertion, the value
+// is escaped
+func (a AttributeTypeAndValue) String() string {
+	return a.Type + "=" + escapeValue(a.Value)
+}
+
+// Normalize returns the DN in its normalized form: the attribute types are
+// lower cased, named when known by their OID, the values are normalized
+// according to the equality rule of their type and the assertions of the
+// multi-valued RDNs are sorted. Two DNs are equal when their normalized
+// forms are.
+func (d DN) Normalize() DN {
+	n := make(DN, len(d))
+	for i, rdn := range d {
+		n[i] = rdn.Normalize()
+	}
+	return n
+}
+
+// Normalize returns the RDN in its normalized form, see DN.Normalize
+func (r RDN) Normalize() RDN {
+	n := make(RDN, len(r))
+	for i, ava := range r {
+		n[i] = ava.Normalize()
+	}
+	sort.Slice(n, func(i, j int) bool {
+		return n[i].String() < n[j].String()
+	})
+	return n
+}
+
+// Normalize returns the assertion in its normalized form, see
+// DN.Normalize
+func (a AttributeTypeAndValue) Normalize() AttributeTypeAndValue {
+	t, _ := lookupAttribute(a.Type)
+	return AttributeTypeAndValue{Type: t.name, Value: t.rule.Normalize(a.Value)}
+}
+
+// Equal returns true when both DNs name the same entry
+func (d DN) Equal(o DN) bool {
+	if len(d) != len(o) {
+		return false
+	}
+	for i := range d {
+		if !d[i].Equal(o[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Equal returns true when both RDNs hold the same assertions, in any order
+func (r RDN) Equal(o RDN) bool {
+	return len(r) == len(o) && r.Normalize().String() == o.Normalize().String()
+}
+
+// RDN returns the RDN of the entry, nil for the root DSE
+func (d DN) RDN() RDN {
+	if len(d) == 0 {
+		return nil
+	}
+	return d[0]
+}
+
+// Parent returns the DN of the parent entry, the empty DN for a top level
+// entry and the root DSE
+func (d DN) Parent() DN {
+	if len(d) == 0 {
+		return DN{}
+	}
+	return d[1:]
+}
+
+// Child returns the DN of the entry named rdn below d
+func (d DN) Child(rdn RDN) DN {
+	return append(DN{rdn}, d...)
+}
+
+// IsDescendantOf returns true when d is below base, at any depth
+func (d DN) IsDescendantOf(base DN) bool {
+	return len(d) > len(base) && d.InSubtree(base)
+}
+
+// InSubtree returns true when d is base or one of its descendants
+func (d DN) InSubtree(base DN) bool {
+	if len(d) < len(base) {
+		return false
+	}
+	return d[len(d)-len(base):].Equal(base)
+}
+
+// Rebase returns the DN of the entry once the subtree oldBase is moved to
+// newBase, false when d is not in the subtree of oldBase
+func (d DN) Rebase(oldBase, newBase DN) (DN, bool) {
+	if !d.InSubtree(oldBase) {
+		return nil, false
+	}
+	n := make(DN, 0, len(d)-len(oldBase)+len(newBase))
+	n = append(n, d[:len(d)-len(oldBase)]...)
+	return append(n, newBase...), true
+}
+
+// parser reads a DN from its string representation
+type parser struct {
+	s   string
+	pos int
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *parser) skipSpaces() {
+	for !p.eof() && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// rdn reads the assertions of a RDN, up to the end or a comma
+func (p *parser) rdn() (RDN, error) {
+	var rdn RDN
+	for {
+		ava, err := p.attributeTypeAndValue()
+		if err != nil {
+			return nil, err
+		}
+		rdn = append(rdn, ava)
+		if p.eof() || p.s[p.pos] == ',' {
+			return rdn, nil
+		}
+		// attributeTypeAndValue stops at the end, a comma or a plus
+		p.pos++
+	}
+}
+
+func (p *parser) attributeTypeAndValue() (AttributeTypeAndValue, error) {
+	p.skipSpaces()
+	start := p.pos
+	for !p.eof() && strings.IndexByte("= ,+", p.s[p.pos]) < 0 {
+		p.pos++
+	}
+	t := p.s[start:p.pos]
+	if !isAttributeType(t) {
+		return AttributeTypeAndValue{}, fmt.Errorf("invalid attribute type %q", t)
+	}
+	p.skipSpaces()
+	if p.eof() || p.s[p.pos] != '=' {
+		return AttributeTypeAndValue{}, fmt.Errorf("missing value of %s", t)
+	}
+	p.pos++
+	p.skipSpaces()
+
+	var value string
+	var err error
+	if !p.eof() && p.s[p.pos] == '#' {
+		value, err = p.hexValue()
+	} else {
+		value, err = p.stringValue()
+	}
+	if err != nil {
+		return AttributeTypeAndValue{}, fmt.Errorf("invalid value of %s: %s", t, err)
+	}
+	return AttributeTypeAndValue{Type: t, Value: value}, nil
+}
+
+// stringValue reads a value up to the next unescaped comma or plus, the
+// unescaped trailing spaces are dropped
+func (p *parser) stringValue() (string, error) {
+	var b []byte
+	significant := 0
+	for !p.eof() {
+		c := p.s[p.pos]
+		switch c {
+		case ',', '+':
+			return string(b[:significant]), nil
+		case '"', ';', '<', '>':
+			return "", fmt.Errorf("unescaped %q", c)
+		case '\\':
+			p.pos++
+			if p.eof() {
+				return "", errors.New("escape at the end")
+			}
+			if p.pos+1 < len(p.s) && isHex(p.s[p.pos]) && isHex(p.s[p.pos+1]) {
+				v, _ := hex.DecodeString(p.s[p.pos : p.pos+2])
+				b = append(b, v[0])
+				p.pos += 2
+			} else if strings.IndexByte(escapable, p.s[p.pos]) >= 0 {
+				b = append(b, p.s[p.pos])
+				p.pos++
+			} else {
+				return "", fmt.Errorf("invalid escape \\%c", p.s[p.pos])
+			}
+			significant = len(b)
+			continue
+		}
+		b = append(b, c)
+		if c != ' ' {
+			significant = len(b)
+		}
+		p.pos++
+	}
+	return string(b[:significant]), nil
+}
+
+// hexValue reads a value given as "#" followed by the hex encoding of its
+// BER encoding, the value is the content of the BER element
+func (p *parser) hexValue() (string, error) {
+	p.pos++
+	start := p.pos
+	for !p.eof() && isHex(p.s[p.pos]) {
+		p.pos++
+	}
+	ber, err := hex.DecodeString(p.s[start:p.pos])
+	if err != nil {
+		return "", err
+	}
+	p.skipSpaces()
+	if !p.eof() && p.s[p.pos] != ',' && p.s[p.pos] != '+' {
+		return "", fmt.Errorf("unexpected %q after the hex value", p.s[p.pos])
+	}
+	return berContent(ber)
+}
+
+// berContent returns the content of a BER element
+func berContent(ber []byte) (string, error) {
+	if len(ber) < 2 {
+		return "", errors.New("truncated BER value")
+	}
+	length, offset := int(ber[1]), 2
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 3 || len(ber) < 2+n {
+			return "", errors.New("invalid BER length")
+		}
+		length = 0
+		for _, b := range ber[2 : 2+n] {
+			length = length<<8 | int(b)
+		}
+		offset += n
+	}
+	if len(ber) != offset+length {
+		return "", errors.New("invalid BER length")
+	}
+	return string(ber[offset:]), nil
+}
+
+// escapable are the characters which may be escaped with a backslash
+const escapable = " \"#+,;<=>\\"
+
+// escapeValue escapes an attribute value as required by RFC 4514
+func escapeValue(v string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case strings.IndexByte("\"+,;<>\\", c) >= 0,
+			i == 0 && (c == ' ' || c == '#'),
+			i == len(v)-1 && c == ' ':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// isAttributeType returns true for a descriptor, ie cn, or a numeric OID,
+// ie 2.5.4.3
+func isAttributeType(t string) bool {
+	if t == "" {
+		return false
+	}
+	if t[0] >= '0' && t[0] <= '9' {
+		for _, arc := range strings.Split(t, ".") {
+			if arc == "" || strings.Trim(arc, "0123456789") != "" || len(arc) > 1 && arc[0] == '0' {
+				return false
+			}
+		}
+		return true
+	}
+	for i := 0; i < len(t); i++ {
+		c := t[i]
+		letter := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+		if !letter && (i == 0 || c != '-' && (c < '0' || c > '9')) {
+			return false
+		}
+	}
+	return true
+}
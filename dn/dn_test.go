@@ -0,0 +1,312 @@
+package dn
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		dn   string
+		want DN
+	}{
+		{"root DSE", "", DN{}},
+		{"spaces only", "  ", DN{}},
+		{"simple", "cn=admin,dc=enterprise,dc=org", DN{
+			{{"cn", "admin"}},
+			{{"dc", "enterprise"}},
+			{{"dc", "org"}},
+		}},
+		{"spaces around separators", " cn = admin , dc = org ", DN{
+			{{"cn", "admin"}},
+			{{"dc", "org"}},
+		}},
+		{"case kept", "CN=Admin,DC=Org", DN{
+			{{"CN", "Admin"}},
+			{{"DC", "Org"}},
+		}},
+		{"escaped comma", `cn=Kirk\, James,dc=org`, DN{
+			{{"cn", "Kirk, James"}},
+			{{"dc", "org"}},
+		}},
+		{"escaped specials", `cn=a\+b\;c\<d\>e\"f\\g\=h`, DN{
+			{{"cn", `a+b;c<d>e"f\g=h`}},
+		}},
+		{"escaped leading hash", `cn=\#1`, DN{{{"cn", "#1"}}}},
+		{"escaped spaces at the edges", `cn=\ kirk\ ,dc=org`, DN{
+			{{"cn", " kirk "}},
+			{{"dc", "org"}},
+		}},
+		{"escaped space before unescaped ones", `cn=kirk\  ,dc=org`, DN{
+			{{"cn", "kirk "}},
+			{{"dc", "org"}},
+		}},
+		{"inner spaces kept", "cn=James  T Kirk", DN{{{"cn", "James  T Kirk"}}}},
+		{"hex escapes", `cn=\4b\69rk,dc=org`, DN{
+			{{"cn", "Kirk"}},
+			{{"dc", "org"}},
+		}},
+		{"utf-8 hex escapes", `cn=Lu\c4\8di\c4\87`, DN{{{"cn", "Lučić"}}}},
+		{"hex BER value", "cn=#04046b69726b,dc=org", DN{
+			{{"cn", "kirk"}},
+			{{"dc", "org"}},
+		}},
+		{"hex BER value in multi-valued RDN", "cn=#04046b69726b+uid=1", DN{
+			{{"cn", "kirk"}, {"uid", "1"}},
+		}},
+		{"multi-valued RDN", "cn=kirk+uid=kirkj,dc=org", DN{
+			{{"cn", "kirk"}, {"uid", "kirkj"}},
+			{{"dc", "org"}},
+		}},
+		{"OID type", "2.5.4.3=kirk", DN{{{"2.5.4.3", "kirk"}}}},
+		{"empty value", "cn=,dc=org", DN{
+			{{"cn", ""}},
+			{{"dc", "org"}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.dn)
+			if err != nil {
+				t.Fatalf("Parse(%q): %s", tt.dn, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse(%q) = %#v, want %#v", tt.dn, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		dn   string
+	}{
+		{"empty RDN", "cn=a,,dc=org"},
+		{"trailing comma", "cn=a,"},
+		{"trailing plus", "cn=a+"},
+		{"trailing backslash", `cn=a\`},
+		{"missing type", "=a"},
+		{"missing equal", "cn"},
+		{"missing equal in second RDN", "cn=a,dc"},
+		{"invalid escape", `cn=a\zb`},
+		{"single hex digit escape", `cn=a\4`},
+		{"unescaped semicolon", "cn=a;b"},
+		{"unescaped quote", `cn=a"b`},
+		{"unescaped angle bracket", "cn=a<b"},
+		{"type starting with a digit", "1cn=a"},
+		{"type with underscore", "c_n=a"},
+		{"OID with leading zero", "2.05.4.3=a"},
+		{"OID with empty arc", "2..4.3=a"},
+		{"empty hex value", "cn=#"},
+		{"odd hex value", "cn=#04016"},
+		{"text after hex value", "cn=#04046b69726bxyz"},
+		{"hex value too short", "cn=#04056b69726b"},
+		{"hex value too long", "cn=#04036b69726b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if d, err := Parse(tt.dn); err == nil {
+				t.Errorf("Parse(%q) = %#v, want an error", tt.dn, d)
+			}
+		})
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		dn   DN
+		want string
+	}{
+		{DN{}, ""},
+		{DN{{{"cn", "admin"}}, {{"dc", "org"}}}, "cn=admin,dc=org"},
+		{DN{{{"cn", "Kirk, James"}}}, `cn=Kirk\, James`},
+		{DN{{{"cn", `a+b;c<d>e"f\g`}}}, `cn=a\+b\;c\<d\>e\"f\\g`},
+		{DN{{{"cn", " kirk "}}}, `cn=\ kirk\ `},
+		{DN{{{"cn", "#1"}}}, `cn=\#1`},
+		{DN{{{"cn", "a#1"}}}, `cn=a#1`},
+		{DN{{{"cn", "a\nb"}}}, `cn=a\0ab`},
+		{DN{{{"cn", "kirk"}, {"uid", "kirkj"}}, {{"dc", "org"}}}, "cn=kirk+uid=kirkj,dc=org"},
+	}
+	for _, tt := range tests {
+		got := tt.dn.String()
+		if got != tt.want {
+			t.Errorf("%#v.String() = %q, want %q", tt.dn, got, tt.want)
+		}
+		// the representation parses back to the same DN
+		d, err := Parse(got)
+		if err != nil {
+			t.Errorf("Parse(%q): %s", got, err)
+			continue
+		}
+		if !reflect.DeepEqual(d, tt.dn) {
+			t.Errorf("Parse(%q) = %#v, want %#v", got, d, tt.dn)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		dn   string
+		want string
+	}{
+		{"CN=Admin,DC=Enterprise,DC=Org", "cn=admin,dc=enterprise,dc=org"},
+		{"cn=James   T  Kirk", "cn=james t kirk"},
+		{"2.5.4.3=Kirk", "cn=kirk"},
+		{"commonName=Kirk", "cn=kirk"},
+		{"gn=John", "givenname=john"},
+		{"2.5.4.42=John", "givenname=john"},
+		{"uidNumber=007", "uidnumber=7"},
+		{"userPassword=Secret", "userpassword=Secret"},
+		{"fooBar=Baz", "foobar=baz"},
+		{"uid=kirkj+cn=Kirk", "cn=kirk+uid=kirkj"},
+		{`cn=Kirk\, James`, `cn=kirk\, james`},
+	}
+	for _, tt := range tests {
+		d, err := Parse(tt.dn)
+		if err != nil {
+			t.Fatalf("Parse(%q): %s", tt.dn, err)
+		}
+		if got := d.Normalize().String(); got != tt.want {
+			t.Errorf("Parse(%q).Normalize() = %q, want %q", tt.dn, got, tt.want)
+		}
+	}
+}
+
+func TestEqual(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"cn=admin,dc=org", "cn=admin,dc=org", true},
+		{"cn=admin,dc=org", "CN=Admin,DC=ORG", true},
+		{"cn=admin,dc=org", " cn = admin , dc = org ", true},
+		{"cn=James T Kirk", "cn=james  t   kirk", true},
+		{"cn=kirk", `cn=\6b\69\72\6b`, true},
+		{"cn=kirk", "cn=#04046b69726b", true},
+		{"cn=kirk", "2.5.4.3=kirk", true},
+		{"cn=kirk", "commonName=kirk", true},
+		{"commonName=kirk", "2.5.4.3=kirk", true},
+		{"givenName=John,dc=org", "gn=John,dc=org", true},
+		{"gn=John,dc=org", "2.5.4.42=John,dc=org", true},
+		{"givenName=John,dc=org", "2.5.4.42=John,dc=org", true},
+		{"sn=Kirk", "surname=kirk", true},
+		{"uid=kirkj", "userid=kirkj", true},
+		{"dc=org", "domainComponent=org", true},
+		{"mail=a@b", "rfc822Mailbox=a@b", true},
+		{"ou=crew", "organizationalUnitName=crew", true},
+		{"o=enterprise", "organizationName=enterprise", true},
+		{"c=us", "countryName=US", true},
+		{"uidNumber=7", "uidNumber=007", true},
+		{"cn=kirk+uid=kirkj,dc=org", "uid=kirkj+cn=kirk,dc=org", true},
+		{"", "", true},
+
+		{"cn=admin,dc=org", "cn=admin", false},
+		{"cn=admin,dc=org", "cn=root,dc=org", false},
+		{"cn=admin,dc=org", "uid=admin,dc=org", false},
+		{"cn=kirk", "cn=kirk+uid=kirkj", false},
+		{"cn=kirk+uid=kirkj", "cn=kirk+uid=spock", false},
+		{"cn=kirk", "sn=kirk", false},
+		{"userPassword=Secret", "userPassword=secret", false},
+		{"cn=kirk", "", false},
+	}
+	for _, tt := range tests {
+		a, err := Parse(tt.a)
+		if err != nil {
+			t.Fatalf("Parse(%q): %s", tt.a, err)
+		}
+		b, err := Parse(tt.b)
+		if err != nil {
+			t.Fatalf("Parse(%q): %s", tt.b, err)
+		}
+		if got := a.Equal(b); got != tt.want {
+			t.Errorf("Parse(%q).Equal(%q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+		if got := b.Equal(a); got != tt.want {
+			t.Errorf("Parse(%q).Equal(%q) = %v, want %v", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func mustParse(t *testing.T, s string) DN {
+	t.Helper()
+	d, err := Parse(s)
+	if err != nil {
+		t.Fatalf("Parse(%q): %s", s, err)
+	}
+	return d
+}
+
+func TestParent(t *testing.T) {
+	tests := []struct {
+		dn   string
+		want string
+	}{
+		{"cn=kirkj,ou=crew,dc=org", "ou=crew,dc=org"},
+		{"dc=org", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got := mustParse(t, tt.dn).Parent()
+		if got == nil || !got.Equal(mustParse(t, tt.want)) {
+			t.Errorf("Parse(%q).Parent() = %q, want %q", tt.dn, got, tt.want)
+		}
+	}
+}
+
+func TestSubtree(t *testing.T) {
+	tests := []struct {
+		dn, base     string
+		inSubtree    bool
+		isDescendant bool
+	}{
+		{"cn=kirkj,ou=crew,dc=org", "ou=crew,dc=org", true, true},
+		{"cn=kirkj,ou=crew,dc=org", "dc=org", true, true},
+		{"cn=kirkj,ou=crew,dc=org", "DC=Org", true, true},
+		{"cn=kirkj,ou=crew,dc=org", "domainComponent=org", true, true},
+		{"cn=kirkj,ou=crew,dc=org", "", true, true},
+		{"ou=crew,dc=org", "ou=crew,dc=org", true, false},
+		{"", "", true, false},
+		{"ou=crew,dc=org", "cn=kirkj,ou=crew,dc=org", false, false},
+		{"cn=kirkj,ou=crew,dc=org", "ou=ship,dc=org", false, false},
+		{"cn=kirkj,ou=crew,dc=org", "ou=crew", false, false},
+		{"cn=kirkj,ou=crew,dc=org", "dc=com", false, false},
+	}
+	for _, tt := range tests {
+		d, base := mustParse(t, tt.dn), mustParse(t, tt.base)
+		if got := d.InSubtree(base); got != tt.inSubtree {
+			t.Errorf("Parse(%q).InSubtree(%q) = %v, want %v", tt.dn, tt.base, got, tt.inSubtree)
+		}
+		if got := d.IsDescendantOf(base); got != tt.isDescendant {
+			t.Errorf("Parse(%q).IsDescendantOf(%q) = %v, want %v", tt.dn, tt.base, got, tt.isDescendant)
+		}
+	}
+}
+
+func TestRebase(t *testing.T) {
+	tests := []struct {
+		dn, oldBase, newBase string
+		want                 string
+		ok                   bool
+	}{
+		{"cn=kirkj,ou=crew,dc=org", "ou=crew,dc=org", "ou=officers,dc=org", "cn=kirkj,ou=officers,dc=org", true},
+		{"cn=kirkj,ou=crew,dc=org", "OU=Crew,DC=Org", "ou=officers,dc=org", "cn=kirkj,ou=officers,dc=org", true},
+		{"cn=kirkj,ou=crew,dc=org", "dc=org", "dc=com", "cn=kirkj,ou=crew,dc=com", true},
+		{"cn=kirkj,ou=crew,dc=org", "dc=org", "", "cn=kirkj,ou=crew", true},
+		{"ou=crew,dc=org", "ou=crew,dc=org", "ou=officers,dc=com", "ou=officers,dc=com", true},
+		{"cn=kirkj,ou=crew,dc=org", "ou=ship,dc=org", "ou=officers,dc=org", "", false},
+		{"ou=crew,dc=org", "cn=kirkj,ou=crew,dc=org", "dc=com", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := mustParse(t, tt.dn).Rebase(mustParse(t, tt.oldBase), mustParse(t, tt.newBase))
+		if ok != tt.ok {
+			t.Errorf("Parse(%q).Rebase(%q, %q) ok = %v, want %v", tt.dn, tt.oldBase, tt.newBase, ok, tt.ok)
+			continue
+		}
+		if ok && got.String() != tt.want {
+			t.Errorf("Parse(%q).Rebase(%q, %q) = %q, want %q", tt.dn, tt.oldBase, tt.newBase, got, tt.want)
+		}
+	}
+
+}
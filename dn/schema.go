@@ -0,0 +1,137 @@
+package dn
+
+import (
+	"strings"
+	"sync"
+)
+
+// EqualityRule is the equality matching rule of an attribute type, it
+// tells which differences between two values are not significant
+type EqualityRule int
+
+// Equality rules
+const (
+	// CaseIgnoreMatch ignores the case and the insignificant spaces
+	CaseIgnoreMatch EqualityRule = iota
+	// CaseExactMatch ignores the insignificant spaces
+	CaseExactMatch
+	// IntegerMatch ignores the leading zeros
+	IntegerMatch
+	// OctetStringMatch compares the values byte by byte
+	OctetStringMatch
+)
+
+// attributeType is the name and equality rule of an attribute type
+type attributeType struct {
+	name string
+	rule EqualityRule
+}
+
+var (
+	schemaMutex sync.RWMutex
+	// schema maps the lower cased names and the OIDs of the attribute
+	// types to their definition
+	schema = make(map[string]attributeType)
+)
+
+func init() {
+	for _, a := range []struct {
+		name, oid string
+		rule      EqualityRule
+		aliases   []string
+	}{
+		{"objectClass", "2.5.4.0", CaseIgnoreMatch, nil},
+		{"cn", "2.5.4.3", CaseIgnoreMatch, []string{"commonName"}},
+		{"sn", "2.5.4.4", CaseIgnoreMatch, []string{"surname"}},
+		{"serialNumber", "2.5.4.5", CaseIgnoreMatch, nil},
+		{"c", "2.5.4.6", CaseIgnoreMatch, []string{"countryName"}},
+		{"l", "2.5.4.7", CaseIgnoreMatch, []string{"localityName"}},
+		{"st", "2.5.4.8", CaseIgnoreMatch, []string{"stateOrProvinceName"}},
+		{"street", "2.5.4.9", CaseIgnoreMatch, []string{"streetAddress"}},
+		{"o", "2.5.4.10", CaseIgnoreMatch, []string{"organizationName"}},
+		{"ou", "2.5.4.11", CaseIgnoreMatch, []string{"organizationalUnitName"}},
+		{"title", "2.5.4.12", CaseIgnoreMatch, nil},
+		{"description", "2.5.4.13", CaseIgnoreMatch, nil},
+		{"telephoneNumber", "2.5.4.20", CaseIgnoreMatch, nil},
+		{"member", "2.5.4.31", CaseIgnoreMatch, nil},
+		{"userPassword", "2.5.4.35", OctetStringMatch, nil},
+		{"userCertificate", "2.5.4.36", OctetStringMatch, nil},
+		{"givenName", "2.5.4.42", CaseIgnoreMatch, []string{"gn"}},
+		{"displayName", "2.16.840.1.113730.3.1.241", CaseIgnoreMatch, nil},
+		{"createTimestamp", "2.5.18.1", CaseIgnoreMatch, nil},
+		{"modifyTimestamp", "2.5.18.2", CaseIgnoreMatch, nil},
+		{"uid", "0.9.2342.19200300.100.1.1", CaseIgnoreMatch, []string{"userid"}},
+		{"mail", "0.9.2342.19200300.100.1.3", CaseIgnoreMatch, []string{"rfc822Mailbox"}},
+		{"dc", "0.9.2342.19200300.100.1.25", CaseIgnoreMatch, []string{"domainComponent"}},
+		{"jpegPhoto", "0.9.2342.19200300.100.1.60", OctetStringMatch, nil},
+		{"uidNumber", "1.3.6.1.1.1.1.0", IntegerMatch, nil},
+		{"gidNumber", "1.3.6.1.1.1.1.1", IntegerMatch, nil},
+		{"userAccountControl", "1.2.840.113556.1.4.8", IntegerMatch, nil},
+		{"sAMAccountName", "1.2.840.113556.1.4.221", CaseIgnoreMatch, nil},
+		{"userPrincipalName", "1.2.840.113556.1.4.656", CaseIgnoreMatch, nil},
+		{"memberOf", "1.2.840.113556.1.2.102", CaseIgnoreMatch, nil},
+	} {
+		RegisterAttribute(a.name, a.oid, a.rule, a.aliases...)
+	}
+}
+
+// RegisterAttribute declares an attribute type with its OID, which may be
+// empty, its equality rule and the other names it is known by. The
+// attribute type is looked up by any of them but is always named name.
+// The values of the attribute types not registered are compared with
+// CaseIgnoreMatch, the filters on them are Undefined.
+func RegisterAttribute(name, oid string, rule EqualityRule, aliases ...string) {
+	schemaMutex.Lock()
+	defer schemaMutex.Unlock()
+	t := attributeType{name: strings.ToLower(name), rule: rule}
+	schema[t.name] = t
+	if oid != "" {
+		schema[oid] = t
+	}
+	for _, alias := range aliases {
+		schema[strings.ToLower(alias)] = t
+	}
+}
+
+// LookupAttribute returns the lower cased name and the equality rule of an
+// attribute type given by name or OID, false when the attribute type is
+// not registered
+func LookupAttribute(name string) (string, EqualityRule, bool) {
+	t, ok := lookupAttribute(name)
+	return t.name, t.rule, ok
+}
+
+// lookupAttribute returns the definition of an attribute type given by
+// name or OID, the CaseIgnoreMatch rule when it is not registered
+func lookupAttribute(name string) (attributeType, bool) {
+	key := strings.ToLower(name)
+	schemaMutex.RLock()
+	defer schemaMutex.RUnlock()
+	if t, ok := schema[key]; ok {
+		return t, true
+	}
+	return attributeType{name: key, rule: CaseIgnoreMatch}, false
+}
+
+// Normalize returns the value in a form where the differences the rule
+// ignores are removed
+func (rule EqualityRule) Normalize(v string) string {
+	switch rule {
+	case CaseIgnoreMatch:
+		return strings.ToLower(strings.Join(strings.Fields(v), " "))
+	case CaseExactMatch:
+		return strings.Join(strings.Fields(v), " ")
+	case IntegerMatch:
+		v = strings.TrimSpace(v)
+		sign := ""
+		if strings.HasPrefix(v, "-") {
+			sign, v = "-", v[1:]
+		}
+		v = strings.TrimLeft(v, "0")
+		if v == "" {
+			return "0"
+		}
+		return sign + v
+	}
+	return v
+}
@@ -0,0 +1,70 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jsimonetti/ldapserv/internal/ber"
+	"github.com/lor00x/goldap/message"
+)
+
+// goldap does not allow to build a filter from outside its package, the
+// compiled filter is BER encoded and decoded by goldap as part of a search
+// request.
+
+// BER identifier octets of the filter choices
+const (
+	tagAnd             byte = 0xa0
+	tagOr              byte = 0xa1
+	tagNot             byte = 0xa2
+	tagEqualityMatch   byte = 0xa3
+	tagSubstrings      byte = 0xa4
+	tagGreaterOrEqual  byte = 0xa5
+	tagLessOrEqual     byte = 0xa6
+	tagPresent         byte = 0x87
+	tagApproxMatch     byte = 0xa8
+	tagExtensibleMatch byte = 0xa9
+
+	tagSubstringInitial byte = 0x80
+	tagSubstringAny     byte = 0x81
+	tagSubstringFinal   byte = 0x82
+
+	tagMatchingRule byte = 0x81
+	tagMatchingType byte = 0x82
+	tagMatchValue   byte = 0x83
+	tagDnAttributes byte = 0x84
+
+	tagSearch byte = 0x63
+)
+
+// decode returns the goldap filter of a BER encoded filter
+func decode(encoded []byte) (f message.Filter, err error) {
+	// goldap panics on some malformed elements
+	defer func() {
+		if r := recover(); r != nil {
+			f, err = nil, fmt.Errorf("%v", r)
+		}
+	}()
+
+	search := ber.Encode(tagSearch,
+		ber.OctetString(nil), // baseObject
+		ber.Enumerated(0),    // scope
+		ber.Enumerated(0),    // derefAliases
+		ber.Integer(0),       // sizeLimit
+		ber.Integer(0),       // timeLimit
+		ber.Boolean(false),   // typesOnly
+		encoded,
+		ber.Sequence(), // attributes
+	)
+	packet := ber.Sequence(ber.Integer(1), search)
+
+	m, err := message.ReadLDAPMessage(message.NewBytes(0, packet))
+	if err != nil {
+		return nil, err
+	}
+	r, ok := m.ProtocolOp().(message.SearchRequest)
+	if !ok {
+		return nil, errors.New("unexpected protocol op")
+	}
+	return r.Filter(), nil
+}
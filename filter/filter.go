@@ -0,0 +1,464 @@
+// Package filter compiles the string representation of LDAP search filters
+// to goldap filters and back, and evaluates filters against entries.
+// @see RFC https://tools.ietf.org/html/rfc4515
+package filter
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/jsimonetti/ldapserv/dn"
+	"github.com/jsimonetti/ldapserv/internal/ber"
+	"github.com/lor00x/goldap/message"
+)
+
+// Compile parses the string representation of a filter, ie
+// (&(objectClass=person)(cn=J*)). The parentheses around a single item may
+// be omitted.
+func Compile(s string) (message.Filter, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "(") {
+		s = "(" + s + ")"
+	}
+	p := &parser{s: s}
+	encoded, err := p.filter()
+	if err == nil && !p.eof() {
+		err = fmt.Errorf("unexpected %q after the filter", p.s[p.pos:])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %s", s, err)
+	}
+	f, err := decode(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %s", s, err)
+	}
+	return f, nil
+}
+
+// Decompile returns the string representation of a filter, the asserted
+// values are escaped
+func Decompile(f message.Filter) (string, error) {
+	var b strings.Builder
+	if err := decompile(&b, f, false); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Equal returns true when both filters are the same once normalized: the
+// attribute types are lower cased, named when known by their OID, the
+// values are normalized according to the equality rule of their type and
+// the order of the filters of an and or an or does not matter.
+func Equal(a, b message.Filter) bool {
+	var sa, sb strings.Builder
+	if decompile(&sa, a, true) != nil || decompile(&sb, b, true) != nil {
+		return false
+	}
+	return sa.String() == sb.String()
+}
+
+// decompile writes the string representation of the filter, its normalized
+// form when normalize is set
+func decompile(b *strings.Builder, f message.Filter, normalize bool) error {
+	attribute := func(desc message.AttributeDescription) (string, dn.EqualityRule) {
+		if !normalize {
+			return string(desc), dn.OctetStringMatch
+		}
+		name, rule, _ := dn.LookupAttribute(attributeType(string(desc)))
+		return name, rule
+	}
+
+	switch f := f.(type) {
+	case message.FilterAnd, message.FilterOr:
+		op, children := "&", []message.Filter(nil)
+		if and, ok := f.(message.FilterAnd); ok {
+			children = and
+		} else {
+			op, children = "|", f.(message.FilterOr)
+		}
+		parts := make([]string, len(children))
+		for i, child := range children {
+			var cb strings.Builder
+			if err := decompile(&cb, child, normalize); err != nil {
+				return err
+			}
+			parts[i] = cb.String()
+		}
+		if normalize {
+			sort.Strings(parts)
+		}
+		b.WriteString("(" + op + strings.Join(parts, "") + ")")
+	case message.FilterNot:
+		b.WriteString("(!")
+		if err := decompile(b, f.Filter, normalize); err != nil {
+			return err
+		}
+		b.WriteString(")")
+	case message.FilterEqualityMatch:
+		name, rule := attribute(f.AttributeDesc())
+		b.WriteString("(" + name + "=" + escape(rule.Normalize(string(f.AssertionValue()))) + ")")
+	case message.FilterGreaterOrEqual:
+		name, rule := attribute(f.AttributeDesc())
+		b.WriteString("(" + name + ">=" + escape(rule.Normalize(string(f.AssertionValue()))) + ")")
+	case message.FilterLessOrEqual:
+		name, rule := attribute(f.AttributeDesc())
+		b.WriteString("(" + name + "<=" + escape(rule.Normalize(string(f.AssertionValue()))) + ")")
+	case message.FilterApproxMatch:
+		name, rule := attribute(f.AttributeDesc())
+		b.WriteString("(" + name + "~=" + escape(rule.Normalize(string(f.AssertionValue()))) + ")")
+	case message.FilterPresent:
+		name, _ := attribute(message.AttributeDescription(f))
+		b.WriteString("(" + name + "=*)")
+	case message.FilterSubstrings:
+		name, rule := attribute(f.Type_())
+		initial, any, final := substrings(&f)
+		if normalize {
+			initial, final = normalizeSubstring(rule, initial), normalizeSubstring(rule, final)
+			for i := range any {
+				any[i] = normalizeSubstring(rule, any[i])
+			}
+		}
+		b.WriteString("(" + name + "=" + escape(initial) + "*")
+		for _, s := range any {
+			b.WriteString(escape(s) + "*")
+		}
+		b.WriteString(escape(final) + ")")
+	case message.FilterExtensibleMatch:
+		a := matchingRuleAssertionOf(f)
+		b.WriteString("(")
+		if a.Type != "" {
+			name, _ := attribute(message.AttributeDescription(a.Type))
+			b.WriteString(name)
+		}
+		if a.DNAttributes {
+			b.WriteString(":dn")
+		}
+		if a.MatchingRule != "" {
+			rule := a.MatchingRule
+			if normalize {
+				rule = strings.ToLower(rule)
+			}
+			b.WriteString(":" + rule)
+		}
+		b.WriteString(":=" + escape(a.MatchValue) + ")")
+	default:
+		return fmt.Errorf("unknown filter %T", f)
+	}
+	return nil
+}
+
+// substrings returns the components of a substrings filter, empty when
+// not present
+func substrings(f *message.FilterSubstrings) (initial string, any []string, final string) {
+	for _, s := range f.Substrings() {
+		switch s := s.(type) {
+		case message.SubstringInitial:
+			initial = string(s)
+		case message.SubstringAny:
+			any = append(any, string(s))
+		case message.SubstringFinal:
+			final = string(s)
+		}
+	}
+	return
+}
+
+// matchingRuleAssertion is the content of an extensible match filter
+type matchingRuleAssertion struct {
+	MatchingRule string
+	Type         string
+	MatchValue   string
+	DNAttributes bool
+}
+
+// matchingRuleAssertionOf returns the content of an extensible match
+// filter, goldap has no getter for its fields
+func matchingRuleAssertionOf(f message.FilterExtensibleMatch) matchingRuleAssertion {
+	var a matchingRuleAssertion
+	v := reflect.ValueOf(f)
+	if rule := v.FieldByName("matchingRule"); !rule.IsNil() {
+		a.MatchingRule = rule.Elem().String()
+	}
+	if t := v.FieldByName("type_"); !t.IsNil() {
+		a.Type = t.Elem().String()
+	}
+	a.MatchValue = v.FieldByName("matchValue").String()
+	a.DNAttributes = v.FieldByName("dnAttributes").Bool()
+	return a
+}
+
+// attributeType returns the type of an attribute description, without
+// its options
+func attributeType(desc string) string {
+	if i := strings.IndexByte(desc, ';'); i >= 0 {
+		return desc[:i]
+	}
+	return desc
+}
+
+// normalizeSubstring lower cases the component of a substrings filter for
+// CaseIgnoreMatch and folds its runs of spaces, unlike the values its
+// leading and trailing spaces are significant
+func normalizeSubstring(rule dn.EqualityRule, s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' && i > 0 && s[i-1] == ' ' {
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	if rule == dn.CaseIgnoreMatch {
+		return strings.ToLower(b.String())
+	}
+	return b.String()
+}
+
+// escape escapes an asserted value as required by RFC 4515
+func escape(v string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// parser reads a filter from its string representation and returns its
+// BER encoding
+type parser struct {
+	s   string
+	pos int
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.s)
+}
+
+// filter reads a parenthesized filter
+func (p *parser) filter() ([]byte, error) {
+	if p.eof() || p.s[p.pos] != '(' {
+		return nil, fmt.Errorf("missing ( at %d", p.pos)
+	}
+	p.pos++
+	if p.eof() {
+		return nil, errors.New("unexpected end")
+	}
+
+	var encoded []byte
+	var err error
+	switch p.s[p.pos] {
+	case '&':
+		p.pos++
+		encoded, err = p.list(tagAnd)
+	case '|':
+		p.pos++
+		encoded, err = p.list(tagOr)
+	case '!':
+		p.pos++
+		var child []byte
+		if child, err = p.filter(); err == nil {
+			encoded = ber.Encode(tagNot, child)
+		}
+	default:
+		encoded, err = p.item()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if p.eof() || p.s[p.pos] != ')' {
+		return nil, fmt.Errorf("missing ) at %d", p.pos)
+	}
+	p.pos++
+	return encoded, nil
+}
+
+// list reads the filters of an and or an or
+func (p *parser) list(tag byte) ([]byte, error) {
+	var children [][]byte
+	for !p.eof() && p.s[p.pos] == '(' {
+		child, err := p.filter()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+	if len(children) == 0 {
+		return nil, fmt.Errorf("empty filter list at %d", p.pos)
+	}
+	return ber.Encode(tag, children...), nil
+}
+
+// item reads a simple, present, substrings or extensible filter, up to
+// the closing parenthesis
+func (p *parser) item() ([]byte, error) {
+	start := p.pos
+	for !p.eof() && p.s[p.pos] != ')' {
+		if p.s[p.pos] == '(' {
+			return nil, fmt.Errorf("unexpected ( at %d", p.pos)
+		}
+		p.pos++
+	}
+	item := p.s[start:p.pos]
+
+	i := strings.IndexByte(item, '=')
+	if i < 0 {
+		return nil, fmt.Errorf("missing = in %q", item)
+	}
+	desc, value := item[:i], item[i+1:]
+
+	tag := tagEqualityMatch
+	if desc != "" {
+		switch desc[len(desc)-1] {
+		case ':':
+			return extensibleFilter(desc[:len(desc)-1], value)
+		case '>':
+			tag, desc = tagGreaterOrEqual, desc[:len(desc)-1]
+		case '<':
+			tag, desc = tagLessOrEqual, desc[:len(desc)-1]
+		case '~':
+			tag, desc = tagApproxMatch, desc[:len(desc)-1]
+		}
+	}
+	if !isAttributeDescription(desc) {
+		return nil, fmt.Errorf("invalid attribute description %q", desc)
+	}
+	attribute := ber.OctetString([]byte(desc))
+
+	if tag == tagEqualityMatch && value == "*" {
+		return ber.Encode(tagPresent, []byte(desc)), nil
+	}
+	if tag == tagEqualityMatch && strings.IndexByte(value, '*') >= 0 {
+		return substringsFilter(attribute, value)
+	}
+	v, err := unescape(value)
+	if err != nil {
+		return nil, err
+	}
+	return ber.Encode(tag, attribute, ber.OctetString(v)), nil
+}
+
+// substringsFilter encodes a substrings filter, value holds the components
+// separated by stars
+func substringsFilter(attribute []byte, value string) ([]byte, error) {
+	parts := strings.Split(value, "*")
+	var components [][]byte
+	for i, part := range parts {
+		v, err := unescape(part)
+		if err != nil {
+			return nil, err
+		}
+		tag := tagSubstringAny
+		switch {
+		case i == 0:
+			tag = tagSubstringInitial
+		case i == len(parts)-1:
+			tag = tagSubstringFinal
+		}
+		if len(v) == 0 {
+			if tag == tagSubstringAny {
+				return nil, fmt.Errorf("empty substring in %q", value)
+			}
+			continue
+		}
+		components = append(components, ber.Encode(tag, v))
+	}
+	return ber.Encode(tagSubstrings, attribute, ber.Sequence(components...)), nil
+}
+
+// extensibleFilter encodes an extensible filter, desc is what comes before
+// ":=", ie cn:dn:caseExactMatch
+func extensibleFilter(desc, value string) ([]byte, error) {
+	parts := strings.Split(desc, ":")
+	attribute, parts := parts[0], parts[1:]
+	dnAttributes := false
+	if len(parts) > 0 && strings.EqualFold(parts[0], "dn") {
+		dnAttributes, parts = true, parts[1:]
+	}
+	rule := ""
+	if len(parts) == 1 {
+		rule, parts = parts[0], nil
+	}
+	if len(parts) > 0 || rule == "" && attribute == "" {
+		return nil, fmt.Errorf("invalid extensible match %q", desc+":=")
+	}
+	if attribute != "" && !isAttributeDescription(attribute) {
+		return nil, fmt.Errorf("invalid attribute description %q", attribute)
+	}
+	if rule != "" && !isAttributeDescription(rule) {
+		return nil, fmt.Errorf("invalid matching rule %q", rule)
+	}
+	v, err := unescape(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var elements [][]byte
+	if rule != "" {
+		elements = append(elements, ber.Encode(tagMatchingRule, []byte(rule)))
+	}
+	if attribute != "" {
+		elements = append(elements, ber.Encode(tagMatchingType, []byte(attribute)))
+	}
+	elements = append(elements, ber.Encode(tagMatchValue, v))
+	// goldap fails to read a matching rule assertion without dnAttributes,
+	// its default value is encoded too
+	if dnAttributes {
+		elements = append(elements, ber.Encode(tagDnAttributes, []byte{0xff}))
+	} else {
+		elements = append(elements, ber.Encode(tagDnAttributes, []byte{0x00}))
+	}
+	return ber.Encode(tagExtensibleMatch, elements...), nil
+}
+
+// unescape decodes the \XX escapes of an asserted value
+func unescape(value string) ([]byte, error) {
+	var b []byte
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			b = append(b, value[i])
+			continue
+		}
+		if i+2 >= len(value) {
+			return nil, fmt.Errorf("truncated escape in %q", value)
+		}
+		c, err := hex.DecodeString(value[i+1 : i+3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid escape in %q", value)
+		}
+		b = append(b, c[0])
+		i += 2
+	}
+	return b, nil
+}
+
+// isAttributeDescription returns true for a descriptor or a numeric OID
+// followed by options, ie cn;lang-fr
+func isAttributeDescription(desc string) bool {
+	parts := strings.Split(desc, ";")
+	if parts[0] != "" && parts[0][0] >= '0' && parts[0][0] <= '9' {
+		for _, arc := range strings.Split(parts[0], ".") {
+			if arc == "" || strings.Trim(arc, "0123456789") != "" {
+				return false
+			}
+		}
+		parts = parts[1:]
+	}
+	for _, part := range parts {
+		if part == "" || strings.Trim(part, descriptorChars) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// descriptorChars are the characters allowed in descriptors and options
+const descriptorChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-"
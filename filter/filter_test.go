@@ -0,0 +1,239 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompileDecompile(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter string
+		want   string
+	}{
+		{"equality", "(cn=kirkj)", "(cn=kirkj)"},
+		{"without parentheses", "cn=kirkj", "(cn=kirkj)"},
+		{"present", "(objectClass=*)", "(objectClass=*)"},
+		{"and or not", "(&(objectClass=person)(|(cn=kirkj)(!(cn=spock))))", "(&(objectClass=person)(|(cn=kirkj)(!(cn=spock))))"},
+		{"escaped star", `(cn=a\2ab)`, `(cn=a\2ab)`},
+		{"escaped parentheses", `(cn=\28kirk\29)`, `(cn=\28kirk\29)`},
+		{"upper case escape", `(cn=\2A)`, `(cn=\2a)`},
+		{"escaped backslash and nul", `(cn=\5c\00)`, `(cn=\5c\00)`},
+		{"ordering", "(&(uidNumber>=1000)(uidNumber<=2000))", "(&(uidNumber>=1000)(uidNumber<=2000))"},
+		{"approximate", "(sn~=kurk)", "(sn~=kurk)"},
+		{"substrings initial", "(cn=kir*)", "(cn=kir*)"},
+		{"substrings final", "(cn=*rkj)", "(cn=*rkj)"},
+		{"substrings any", "(cn=*ir*)", "(cn=*ir*)"},
+		{"substrings all", "(mail=james*t*kirk*.org)", "(mail=james*t*kirk*.org)"},
+		{"substrings escaped", `(cn=\2a*\28*\29)`, `(cn=\2a*\28*\29)`},
+		{"extensible type", "(cn:=kirkj)", "(cn:=kirkj)"},
+		{"extensible type and rule", "(sn:caseExactMatch:=Kirk)", "(sn:caseExactMatch:=Kirk)"},
+		{"extensible dn", "(ou:dn:=crew)", "(ou:dn:=crew)"},
+		{"extensible dn and rule", "(ou:dn:2.5.13.2:=crew)", "(ou:dn:2.5.13.2:=crew)"},
+		{"extensible rule only", "(:1.2.840.113556.1.4.803:=2)", "(:1.2.840.113556.1.4.803:=2)"},
+		{"extensible dn and rule only", "(:dn:2.5.13.5:=Kirk)", "(:dn:2.5.13.5:=Kirk)"},
+		{"attribute options", "(cn;lang-en=kirkj)", "(cn;lang-en=kirkj)"},
+		{"oid", "(2.5.4.3=kirkj)", "(2.5.4.3=kirkj)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := Compile(tt.filter)
+			if err != nil {
+				t.Fatalf("Compile(%q): %s", tt.filter, err)
+			}
+			got, err := Decompile(f)
+			if err != nil {
+				t.Fatalf("Decompile(%q): %s", tt.filter, err)
+			}
+			if got != tt.want {
+				t.Errorf("Decompile(Compile(%q)) = %q, want %q", tt.filter, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter string
+	}{
+		{"empty", ""},
+		{"missing close", "(cn=kirkj"},
+		{"missing close in and", "(&(cn=kirkj)(sn=kirk)"},
+		{"extra close", "(cn=kirkj))"},
+		{"missing open", "(&cn=kirkj))"},
+		{"bad escape", `(cn=\2g)`},
+		{"truncated escape", `(cn=\2)`},
+		{"unescaped parenthesis", "(cn=ki(rkj)"},
+		{"empty and", "(&)"},
+		{"empty or", "(|)"},
+		{"empty not", "(!)"},
+		{"missing value operator", "(cn)"},
+		{"invalid attribute", "(c n=kirkj)"},
+		{"extensible without type or rule", "(:=kirkj)"},
+		{"extensible dn without type or rule", "(:dn:=kirkj)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if f, err := Compile(tt.filter); err == nil {
+				got, _ := Decompile(f)
+				t.Errorf("Compile(%q) = %q, want an error", tt.filter, got)
+			}
+		})
+	}
+}
+
+func TestEqual(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"(cn=kirkj)", "(cn=kirkj)", true},
+		{"(cn=kirkj)", "(CN=KirkJ)", true},
+		{"(cn=kirkj)", "(2.5.4.3=kirkj)", true},
+		{"(cn=kirk  j)", "(cn= kirk j )", true},
+		{"(uidNumber=0042)", "(uidNumber=42)", true},
+		{"(&(cn=kirkj)(sn=kirk))", "(&(sn=kirk)(cn=kirkj))", true},
+		{"(|(cn=kirkj)(sn=kirk))", "(|(sn=kirk)(cn=kirkj))", true},
+		{"(objectClass=*)", "(objectclass=*)", true},
+		{"(cn:caseExactMatch:=x)", "(cn:caseexactmatch:=x)", true},
+		{"(cn=kirkj)", "(cn=spock)", false},
+		{"(cn=kirkj)", "(sn=kirkj)", false},
+		{"(userPassword=secret)", "(userPassword=SECRET)", false},
+		{"(&(cn=kirkj)(sn=kirk))", "(|(cn=kirkj)(sn=kirk))", false},
+		{"(cn=kirkj)", "(!(cn=kirkj))", false},
+		{"(cn=kirk*)", "(cn=kirk)", false},
+		{"(cn>=kirkj)", "(cn<=kirkj)", false},
+		{"(ou:dn:=crew)", "(ou:=crew)", false},
+	}
+	for _, tt := range tests {
+		a, err := Compile(tt.a)
+		if err != nil {
+			t.Fatalf("Compile(%q): %s", tt.a, err)
+		}
+		b, err := Compile(tt.b)
+		if err != nil {
+			t.Fatalf("Compile(%q): %s", tt.b, err)
+		}
+		if got := Equal(a, b); got != tt.want {
+			t.Errorf("Equal(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// entry is an Entry holding its attributes by lower cased name
+type entry struct {
+	dn         string
+	attributes map[string][]string
+}
+
+func (e entry) DN() string {
+	return e.dn
+}
+
+func (e entry) AttributeValues(name string) []string {
+	return e.attributes[strings.ToLower(name)]
+}
+
+func (e entry) AttributeTypes() []string {
+	var types []string
+	for t := range e.attributes {
+		types = append(types, t)
+	}
+	return types
+}
+
+func TestEvaluate(t *testing.T) {
+	kirk := entry{
+		dn: "cn=kirkj,ou=crew,dc=enterprise,dc=org",
+		attributes: map[string][]string{
+			"objectclass":        {"top", "inetOrgPerson"},
+			"cn":                 {"kirkj"},
+			"sn":                 {"Kirk"},
+			"mail":               {"james.t.kirk@enterprise.org"},
+			"uidnumber":          {"1701"},
+			"useraccountcontrol": {"514"},
+			"createtimestamp":    {"20200101120000Z"},
+		},
+	}
+
+	// the filters below are TRUE, FALSE or Undefined for kirk
+	const (
+		isTrue      = "(cn=kirkj)"
+		isFalse     = "(cn=spock)"
+		isUndefined = "(fooBar=5)"
+	)
+
+	tests := []struct {
+		filter string
+		want   Result
+	}{
+		{isTrue, True},
+		{isFalse, False},
+		{isUndefined, Undefined},
+
+		// and: False wins over Undefined, which wins over True
+		{"(&" + isTrue + isTrue + ")", True},
+		{"(&" + isTrue + isFalse + ")", False},
+		{"(&" + isTrue + isUndefined + ")", Undefined},
+		{"(&" + isFalse + isUndefined + ")", False},
+		{"(&" + isUndefined + isFalse + ")", False},
+		{"(&" + isUndefined + isUndefined + ")", Undefined},
+
+		// or: True wins over Undefined, which wins over False
+		{"(|" + isFalse + isFalse + ")", False},
+		{"(|" + isFalse + isTrue + ")", True},
+		{"(|" + isFalse + isUndefined + ")", Undefined},
+		{"(|" + isTrue + isUndefined + ")", True},
+		{"(|" + isUndefined + isTrue + ")", True},
+		{"(|" + isUndefined + isUndefined + ")", Undefined},
+
+		// not: Undefined stays Undefined
+		{"(!" + isTrue + ")", False},
+		{"(!" + isFalse + ")", True},
+		{"(!" + isUndefined + ")", Undefined},
+		{"(!(&" + isTrue + isUndefined + "))", Undefined},
+		{"(!(|" + isFalse + isUndefined + "))", Undefined},
+
+		// items
+		{"(objectClass=*)", True},
+		{"(description=*)", False},
+		{"(fooBar=*)", Undefined},
+		{"(2.5.4.3=KIRKJ)", True},
+		{"(1.2.3.4=kirkj)", Undefined},
+		{"(sn=kirk)", True},
+		{"(uidNumber=01701)", True},
+		{"(uidNumber=abc)", Undefined},
+		{"(mail=james*kirk*.org)", True},
+		{"(mail=*spock*)", False},
+		{"(uidNumber=17*)", Undefined},
+		{"(uidNumber>=1000)", True},
+		{"(uidNumber<=1000)", False},
+		{"(uidNumber>=abc)", Undefined},
+		{"(userAccountControl>=500)", True},
+		{"(fooBar>=5)", Undefined},
+		{"(createTimestamp>=20190101000000Z)", True},
+		{"(createTimestamp<=2019)", Undefined},
+		{"(sn~=kurk)", True},
+		{"(sn~=spock)", False},
+		{"(userAccountControl:1.2.840.113556.1.4.803:=2)", True},
+		{"(userAccountControl:1.2.840.113556.1.4.803:=3)", False},
+		{"(userAccountControl:1.2.840.113556.1.4.804:=3)", True},
+		{"(sn:caseExactMatch:=Kirk)", True},
+		{"(sn:caseExactMatch:=kirk)", False},
+		{"(sn:1.2.3.4:=kirk)", Undefined},
+		{"(ou:=crew)", False},
+		{"(ou:dn:=crew)", True},
+		{"(:dn:caseIgnoreMatch:=CREW)", True},
+		{"(:caseIgnoreMatch:=KIRK)", True},
+	}
+	for _, tt := range tests {
+		f, err := Compile(tt.filter)
+		if err != nil {
+			t.Fatalf("Compile(%q): %s", tt.filter, err)
+		}
+		if got := Evaluate(f, kirk); got != tt.want {
+			t.Errorf("Evaluate(%q) = %s, want %s", tt.filter, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package filter
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/jsimonetti/ldapserv/dn"
+	"github.com/lor00x/goldap/message"
+)
+
+// Entry gives the filters access to the attributes of a backend entry
+type Entry interface {
+	DN() string
+	AttributeValues(name string) []string
+}
+
+// AttributeLister is implemented by the entries able to list their
+// attribute types, an extensible match filter without attribute type is
+// evaluated against all of them
+type AttributeLister interface {
+	AttributeTypes() []string
+}
+
+// Result is the outcome of the evaluation of a filter against an entry,
+// RFC 4511 filters are three-valued
+type Result int
+
+// Filter results, an entry is returned by a search when the filter is True
+const (
+	False Result = iota
+	True
+	Undefined
+)
+
+func (r Result) String() string {
+	switch r {
+	case False:
+		return "FALSE"
+	case True:
+		return "TRUE"
+	}
+	return "Undefined"
+}
+
+// Evaluate evaluates the filter against the entry. The values are
+// compared with the matching rules of the attribute type, see
+// dn.RegisterAttribute and OrderingRule. The filters on unknown attribute
+// types or matching rules, or asserting invalid values, are Undefined.
+func Evaluate(f message.Filter, e Entry) Result {
+	switch f := f.(type) {
+	case message.FilterAnd:
+		// False wins over Undefined, which wins over True
+		result := True
+		for _, child := range f {
+			switch Evaluate(child, e) {
+			case False:
+				return False
+			case Undefined:
+				result = Undefined
+			}
+		}
+		return result
+	case message.FilterOr:
+		// True wins over Undefined, which wins over False
+		result := False
+		for _, child := range f {
+			switch Evaluate(child, e) {
+			case True:
+				return True
+			case Undefined:
+				result = Undefined
+			}
+		}
+		return result
+	case message.FilterNot:
+		switch Evaluate(f.Filter, e) {
+		case True:
+			return False
+		case False:
+			return True
+		}
+		return Undefined
+	case message.FilterPresent:
+		name, _, ok := lookupAttribute(string(f))
+		if !ok {
+			return Undefined
+		}
+		if len(e.AttributeValues(name)) > 0 {
+			return True
+		}
+		return False
+	case message.FilterEqualityMatch:
+		return equalityMatch(string(f.AttributeDesc()), string(f.AssertionValue()), e)
+	case message.FilterSubstrings:
+		return substringsMatch(&f, e)
+	case message.FilterGreaterOrEqual:
+		return orderingMatch(string(f.AttributeDesc()), string(f.AssertionValue()), e, true)
+	case message.FilterLessOrEqual:
+		return orderingMatch(string(f.AttributeDesc()), string(f.AssertionValue()), e, false)
+	case message.FilterApproxMatch:
+		return approxMatch(string(f.AttributeDesc()), string(f.AssertionValue()), e)
+	case message.FilterExtensibleMatch:
+		return extensibleMatch(matchingRuleAssertionOf(f), e)
+	}
+	return Undefined
+}
+
+// lookupAttribute returns the name and the equality rule of the attribute
+// type of a description, false when the description is invalid or the
+// attribute type is not registered
+func lookupAttribute(desc string) (string, dn.EqualityRule, bool) {
+	if !isAttributeDescription(desc) {
+		return "", dn.OctetStringMatch, false
+	}
+	return dn.LookupAttribute(attributeType(desc))
+}
+
+// equalityMatch compares the values of the attribute with the asserted
+// value
+func equalityMatch(desc, value string, e Entry) Result {
+	name, rule, ok := lookupAttribute(desc)
+	if !ok {
+		return Undefined
+	}
+	match, ok := equalityMatcher(rule, value)
+	if !ok {
+		return Undefined
+	}
+	return matchValues(e.AttributeValues(name), match)
+}
+
+// substringsMatch looks for a value of the attribute holding the
+// components of the filter, in order. Only the string attribute types
+// have a substrings rule.
+func substringsMatch(f *message.FilterSubstrings, e Entry) Result {
+	name, rule, ok := lookupAttribute(string(f.Type_()))
+	if !ok || rule != dn.CaseIgnoreMatch && rule != dn.CaseExactMatch {
+		return Undefined
+	}
+	initial, any, final := substrings(f)
+	initial, final = normalizeSubstring(rule, initial), normalizeSubstring(rule, final)
+	for i := range any {
+		any[i] = normalizeSubstring(rule, any[i])
+	}
+	return matchValues(e.AttributeValues(name), func(v string) bool {
+		return containsSubstrings(rule.Normalize(v), initial, any, final)
+	})
+}
+
+// containsSubstrings returns true when v starts with initial, ends with
+// final and holds the any components in order, without overlap
+func containsSubstrings(v, initial string, any []string, final string) bool {
+	if !strings.HasPrefix(v, initial) {
+		return false
+	}
+	v = v[len(initial):]
+	for _, s := range any {
+		i := strings.Index(v, s)
+		if i < 0 {
+			return false
+		}
+		v = v[i+len(s):]
+	}
+	return strings.HasSuffix(v, final)
+}
+
+// orderingMatch compares the values of the attribute with the asserted
+// value using the ordering rule of the attribute, it looks for a value
+// greater or equal, or less or equal, to the asserted value
+func orderingMatch(desc, value string, e Entry, greater bool) Result {
+	name, _, ok := lookupAttribute(desc)
+	if !ok {
+		return Undefined
+	}
+	rule, ok := OrderingRule(name)
+	if !ok || !ValidOrderingValue(rule, value) {
+		return Undefined
+	}
+	return matchValues(e.AttributeValues(name), func(v string) bool {
+		if !ValidOrderingValue(rule, v) {
+			return false
+		}
+		cmp := CompareOrdering(rule, v, value)
+		return greater && cmp >= 0 || !greater && cmp <= 0
+	})
+}
+
+// approxMatch compares the phonetic keys of the values of the attribute
+// and of the asserted value, see approximate. The attributes which are not
+// strings use their equality rule.
+func approxMatch(desc, value string, e Entry) Result {
+	name, rule, ok := lookupAttribute(desc)
+	if !ok {
+		return Undefined
+	}
+	if rule != dn.CaseIgnoreMatch && rule != dn.CaseExactMatch {
+		return equalityMatch(desc, value, e)
+	}
+	asserted := approximate(value)
+	return matchValues(e.AttributeValues(name), func(v string) bool {
+		return approximate(v) == asserted
+	})
+}
+
+// extensibleMatch applies the matching rule of the filter, the equality
+// rule of the attribute when it has none, to the values of the attribute,
+// to all the values of the entry when the filter has no attribute type and
+// to the values of the DN too when dnAttributes is set
+func extensibleMatch(a matchingRuleAssertion, e Entry) Result {
+	var name string
+	rule := dn.CaseIgnoreMatch
+	if a.Type != "" {
+		var ok bool
+		if name, rule, ok = lookupAttribute(a.Type); !ok {
+			return Undefined
+		}
+	}
+
+	var match func(string) bool
+	var ok bool
+	switch {
+	case a.MatchingRule != "":
+		match, ok = ruleMatcher(a.MatchingRule, a.MatchValue)
+	case a.Type != "":
+		match, ok = equalityMatcher(rule, a.MatchValue)
+	}
+	if !ok {
+		return Undefined
+	}
+
+	var values []string
+	switch {
+	case name != "":
+		values = e.AttributeValues(name)
+	default:
+		lister, ok := e.(AttributeLister)
+		if !ok {
+			return Undefined
+		}
+		for _, t := range lister.AttributeTypes() {
+			values = append(values, e.AttributeValues(t)...)
+		}
+	}
+	if a.DNAttributes {
+		entry, err := dn.Parse(e.DN())
+		if err != nil {
+			return Undefined
+		}
+		for _, rdn := range entry {
+			for _, ava := range rdn {
+				if t, _, _ := dn.LookupAttribute(ava.Type); name == "" || t == name {
+					values = append(values, ava.Value)
+				}
+			}
+		}
+	}
+	return matchValues(values, match)
+}
+
+// equalityMatcher returns the function telling whether a value is equal to
+// the asserted value, false when the asserted value is not valid
+func equalityMatcher(rule dn.EqualityRule, value string) (func(string) bool, bool) {
+	if rule == dn.IntegerMatch && !isInteger(value) {
+		return nil, false
+	}
+	asserted := rule.Normalize(value)
+	return func(v string) bool {
+		return rule.Normalize(v) == asserted
+	}, true
+}
+
+// ruleMatcher returns the function applying the matching rule to a value
+// and the asserted value, false when the rule is not supported or the
+// asserted value is not valid. The ordering rules match the values less
+// than the asserted value.
+func ruleMatcher(name, value string) (func(string) bool, bool) {
+	oid, ok := LookupMatchingRule(name)
+	if !ok {
+		return nil, false
+	}
+	if rule, ok := equalityRules[oid]; ok {
+		return equalityMatcher(rule, value)
+	}
+	if orderingRules[oid] {
+		if !ValidOrderingValue(oid, value) {
+			return nil, false
+		}
+		return func(v string) bool {
+			return ValidOrderingValue(oid, v) && CompareOrdering(oid, v, value) < 0
+		}, true
+	}
+
+	// bitwise rules
+	asserted, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	return func(v string) bool {
+		n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return false
+		}
+		if oid == MatchingRuleBitAnd {
+			return n&asserted == asserted
+		}
+		return n&asserted != 0
+	}, true
+}
+
+// matchValues returns True when one of the values matches
+func matchValues(values []string, match func(string) bool) Result {
+	for _, v := range values {
+		if match(v) {
+			return True
+		}
+	}
+	return False
+}
+
+// isInteger returns true when v is a valid value of the IntegerMatch rule
+func isInteger(v string) bool {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "-")
+	return v != "" && strings.Trim(v, "0123456789") == ""
+}
+
+// approximate returns the phonetic key of a value, made of the Soundex
+// codes of its words. The words are separated by anything but letters and
+// digits.
+func approximate(v string) string {
+	words := strings.FieldsFunc(strings.ToLower(v), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, w := range words {
+		words[i] = soundex(w)
+	}
+	return strings.Join(words, " ")
+}
+
+// soundex returns the American Soundex code of a lower cased word, ie r163
+// for robert and rupert. The words which do not start with an ASCII letter
+// are returned as is.
+func soundex(w string) string {
+	if w == "" || w[0] < 'a' || w[0] > 'z' {
+		return w
+	}
+	// the codes of the letters a to z
+	const codes = "01230120022455012623010202"
+	b := []byte{w[0]}
+	last := codes[w[0]-'a']
+	for i := 1; i < len(w) && len(b) < 4; i++ {
+		c := w[i]
+		if c < 'a' || c > 'z' {
+			last = '0'
+			continue
+		}
+		code := codes[c-'a']
+		if code != '0' && code != last {
+			b = append(b, code)
+		}
+		// h and w do not separate letters with the same code
+		if c != 'h' && c != 'w' {
+			last = code
+		}
+	}
+	for len(b) < 4 {
+		b = append(b, '0')
+	}
+	return string(b)
+}
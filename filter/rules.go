@@ -0,0 +1,211 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jsimonetti/ldapserv/dn"
+)
+
+// Matching rules supported by the extensible match filters, the ordering
+// rules are also used by the greaterOrEqual and lessOrEqual filters
+const (
+	MatchingRuleCaseIgnore              = "2.5.13.2"
+	MatchingRuleCaseIgnoreOrdering      = "2.5.13.3"
+	MatchingRuleCaseExact               = "2.5.13.5"
+	MatchingRuleCaseExactOrdering       = "2.5.13.6"
+	MatchingRuleNumericStringOrdering   = "2.5.13.9"
+	MatchingRuleInteger                 = "2.5.13.14"
+	MatchingRuleIntegerOrdering         = "2.5.13.15"
+	MatchingRuleOctetString             = "2.5.13.17"
+	MatchingRuleGeneralizedTimeOrdering = "2.5.13.28"
+	// MatchingRuleBitAnd matches the integer values holding all the bits
+	// of the asserted value, as LDAP_MATCHING_RULE_BIT_AND of Active
+	// Directory
+	MatchingRuleBitAnd = "1.2.840.113556.1.4.803"
+	// MatchingRuleBitOr matches the integer values holding one of the bits
+	// of the asserted value, as LDAP_MATCHING_RULE_BIT_OR of Active
+	// Directory
+	MatchingRuleBitOr = "1.2.840.113556.1.4.804"
+)
+
+var matchingRuleNames = map[string]string{
+	"caseignorematch":              MatchingRuleCaseIgnore,
+	"caseignoreorderingmatch":      MatchingRuleCaseIgnoreOrdering,
+	"caseexactmatch":               MatchingRuleCaseExact,
+	"caseexactorderingmatch":       MatchingRuleCaseExactOrdering,
+	"numericstringorderingmatch":   MatchingRuleNumericStringOrdering,
+	"integermatch":                 MatchingRuleInteger,
+	"integerorderingmatch":         MatchingRuleIntegerOrdering,
+	"octetstringmatch":             MatchingRuleOctetString,
+	"generalizedtimeorderingmatch": MatchingRuleGeneralizedTimeOrdering,
+}
+
+// equalityRules are the equality rules of the matching rules comparing
+// values for equality
+var equalityRules = map[string]dn.EqualityRule{
+	MatchingRuleCaseIgnore:  dn.CaseIgnoreMatch,
+	MatchingRuleCaseExact:   dn.CaseExactMatch,
+	MatchingRuleInteger:     dn.IntegerMatch,
+	MatchingRuleOctetString: dn.OctetStringMatch,
+}
+
+// orderingRules are the OIDs of the ordering matching rules
+var orderingRules = map[string]bool{
+	MatchingRuleCaseIgnoreOrdering:      true,
+	MatchingRuleCaseExactOrdering:       true,
+	MatchingRuleNumericStringOrdering:   true,
+	MatchingRuleIntegerOrdering:         true,
+	MatchingRuleGeneralizedTimeOrdering: true,
+}
+
+// attributeOrderingRules holds the ORDERING of the attributes which is not
+// the one of their equality rule, an empty rule means the attribute has no
+// ordering
+var attributeOrderingRules = map[string]string{
+	"createtimestamp": MatchingRuleGeneralizedTimeOrdering,
+	"modifytimestamp": MatchingRuleGeneralizedTimeOrdering,
+	"objectclass":     "",
+}
+
+// LookupMatchingRule returns the OID of a supported matching rule given by
+// name or OID, false when the rule is not supported
+func LookupMatchingRule(name string) (string, bool) {
+	if oid, ok := matchingRuleNames[strings.ToLower(name)]; ok {
+		return oid, true
+	}
+	if _, ok := equalityRules[name]; ok || orderingRules[name] || name == MatchingRuleBitAnd || name == MatchingRuleBitOr {
+		return name, true
+	}
+	return "", false
+}
+
+// LookupOrderingRule returns the OID of a supported ordering rule given by
+// name or OID, false when the rule is not a supported ordering rule
+func LookupOrderingRule(name string) (string, bool) {
+	oid, ok := LookupMatchingRule(name)
+	return oid, ok && orderingRules[oid]
+}
+
+// OrderingRule returns the ordering rule of an attribute type, the one
+// matching its equality rule unless the attribute is known to order its
+// values otherwise. It returns false for the attributes without ordering.
+func OrderingRule(attribute string) (string, bool) {
+	name, rule, _ := dn.LookupAttribute(attributeType(attribute))
+	if oid, ok := attributeOrderingRules[name]; ok {
+		return oid, oid != ""
+	}
+	switch rule {
+	case dn.CaseExactMatch:
+		return MatchingRuleCaseExactOrdering, true
+	case dn.IntegerMatch:
+		return MatchingRuleIntegerOrdering, true
+	case dn.OctetStringMatch:
+		return "", false
+	}
+	return MatchingRuleCaseIgnoreOrdering, true
+}
+
+// ValidOrderingValue returns true when v can be compared with the ordering
+// rule
+func ValidOrderingValue(rule, v string) bool {
+	switch rule {
+	case MatchingRuleIntegerOrdering:
+		_, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		return err == nil
+	case MatchingRuleGeneralizedTimeOrdering:
+		_, err := parseGeneralizedTime(v)
+		return err == nil
+	}
+	return true
+}
+
+// CompareOrdering compares two valid values according to the ordering
+// rule, it returns -1, 0 or 1 as a is before, equal to or after b
+func CompareOrdering(rule, a, b string) int {
+	switch rule {
+	case MatchingRuleIntegerOrdering:
+		ia, _ := strconv.ParseInt(strings.TrimSpace(a), 10, 64)
+		ib, _ := strconv.ParseInt(strings.TrimSpace(b), 10, 64)
+		switch {
+		case ia < ib:
+			return -1
+		case ia > ib:
+			return 1
+		}
+		return 0
+	case MatchingRuleGeneralizedTimeOrdering:
+		ta, _ := parseGeneralizedTime(a)
+		tb, _ := parseGeneralizedTime(b)
+		switch {
+		case ta.Before(tb):
+			return -1
+		case ta.After(tb):
+			return 1
+		}
+		return 0
+	case MatchingRuleNumericStringOrdering:
+		return strings.Compare(strings.Replace(a, " ", "", -1), strings.Replace(b, " ", "", -1))
+	case MatchingRuleCaseExactOrdering:
+		return strings.Compare(normalizeSpaces(a), normalizeSpaces(b))
+	}
+	return strings.Compare(strings.ToLower(normalizeSpaces(a)), strings.ToLower(normalizeSpaces(b)))
+}
+
+// normalizeSpaces removes leading and trailing spaces and replaces the
+// inner sequences of spaces with a single one
+func normalizeSpaces(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// parseGeneralizedTime parses a GeneralizedTime value such as
+// 20200102150405Z, 202001021504.5+0100 or 2020010215Z
+func parseGeneralizedTime(v string) (time.Time, error) {
+	v = strings.TrimSpace(v)
+	var loc *time.Location
+	switch {
+	case strings.HasSuffix(v, "Z"):
+		v = v[:len(v)-1]
+		loc = time.UTC
+	case len(v) > 5 && (v[len(v)-5] == '+' || v[len(v)-5] == '-'):
+		offset, err := strconv.Atoi(v[len(v)-4:])
+		if err != nil {
+			return time.Time{}, err
+		}
+		seconds := (offset/100*60 + offset%100) * 60
+		if v[len(v)-5] == '-' {
+			seconds = -seconds
+		}
+		loc = time.FixedZone("", seconds)
+		v = v[:len(v)-5]
+	default:
+		loc = time.Local
+	}
+
+	fraction := ""
+	if i := strings.IndexAny(v, ".,"); i >= 0 {
+		fraction = v[i+1:]
+		v = v[:i]
+	}
+	layouts := map[int]string{10: "2006010215", 12: "200601021504", 14: "20060102150405"}
+	layout, ok := layouts[len(v)]
+	if !ok {
+		return time.Time{}, fmt.Errorf("invalid generalized time %q", v)
+	}
+	t, err := time.ParseInLocation(layout, v, loc)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if fraction != "" {
+		f, err := strconv.ParseFloat("0."+fraction, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		// the fraction applies to the last element of the value
+		unit := map[int]time.Duration{10: time.Hour, 12: time.Minute, 14: time.Second}[len(v)]
+		t = t.Add(time.Duration(f * float64(unit)))
+	}
+	return t, nil
+}
@@ -0,0 +1,179 @@
+// Package ber encodes and decodes the few BER structures goldap does not
+// allow to build or read from outside its package: controls, response
+// values, sasl credentials and filters.
+package ber
+
+import (
+	"errors"
+	"fmt"
+)
+
+// BER identifier octets
+const (
+	ClassUniversal   byte = 0x00
+	ClassApplication byte = 0x40
+	ClassContext     byte = 0x80
+	Constructed      byte = 0x20
+
+	TagBoolean     byte = 0x01
+	TagInteger     byte = 0x02
+	TagOctetString byte = 0x04
+	TagEnumerated  byte = 0x0a
+	TagSequence    byte = 0x10 | Constructed
+)
+
+// ErrTruncated is returned when an element is longer than the data
+var ErrTruncated = errors.New("ber: truncated element")
+
+// Element is a decoded BER TLV
+type Element struct {
+	Tag     byte
+	Content []byte
+}
+
+// Length encodes a definite length
+func Length(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+// Encode encodes the concatenated contents with the given identifier octet
+func Encode(tag byte, contents ...[]byte) []byte {
+	content := Concat(contents...)
+	b := append([]byte{tag}, Length(len(content))...)
+	return append(b, content...)
+}
+
+// Sequence encodes a SEQUENCE of the elements
+func Sequence(elements ...[]byte) []byte {
+	return Encode(TagSequence, elements...)
+}
+
+// Concat returns the elements one after the other
+func Concat(elements ...[]byte) []byte {
+	var content []byte
+	for _, e := range elements {
+		content = append(content, e...)
+	}
+	return content
+}
+
+func OctetString(s []byte) []byte {
+	return Encode(TagOctetString, s)
+}
+
+func Boolean(v bool) []byte {
+	if v {
+		return Encode(TagBoolean, []byte{0xff})
+	}
+	return Encode(TagBoolean, []byte{0x00})
+}
+
+func Integer(v int64) []byte {
+	return Encode(TagInteger, IntegerContent(v))
+}
+
+func Enumerated(v int) []byte {
+	return Encode(TagEnumerated, IntegerContent(int64(v)))
+}
+
+// IntegerContent returns the content octets of an INTEGER
+func IntegerContent(v int64) []byte {
+	b := []byte{byte(v)}
+	for v > 127 || v < -128 {
+		v >>= 8
+		b = append([]byte{byte(v)}, b...)
+	}
+	return b
+}
+
+// Decode reads one element from data and returns the remaining bytes
+func Decode(data []byte) (e Element, rest []byte, err error) {
+	if len(data) < 2 {
+		return e, nil, ErrTruncated
+	}
+	e.Tag = data[0]
+	if e.Tag&0x1f == 0x1f {
+		return e, nil, fmt.Errorf("ber: multi-byte tags are not supported")
+	}
+	length := int(data[1])
+	offset := 2
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 {
+			return e, nil, fmt.Errorf("ber: unsupported length encoding %#x", data[1])
+		}
+		if len(data) < offset+n {
+			return e, nil, ErrTruncated
+		}
+		length = 0
+		for _, b := range data[offset : offset+n] {
+			length = length<<8 | int(b)
+		}
+		offset += n
+	}
+	if length < 0 || len(data)-offset < length {
+		return e, nil, ErrTruncated
+	}
+	e.Content = data[offset : offset+length]
+	return e, data[offset+length:], nil
+}
+
+// DecodeAll reads all the elements contained in data
+func DecodeAll(data []byte) ([]Element, error) {
+	var elements []Element
+	for len(data) > 0 {
+		e, rest, err := Decode(data)
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, e)
+		data = rest
+	}
+	return elements, nil
+}
+
+// EncodeElements encodes the elements one after the other
+func EncodeElements(elements []Element) []byte {
+	var content []byte
+	for _, e := range elements {
+		content = append(content, Encode(e.Tag, e.Content)...)
+	}
+	return content
+}
+
+// DecodeSequence decodes a single SEQUENCE and returns its elements
+func DecodeSequence(data []byte) ([]Element, error) {
+	e, rest, err := Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	if e.Tag != TagSequence {
+		return nil, fmt.Errorf("ber: expected a SEQUENCE, got tag %#x", e.Tag)
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("ber: %d trailing bytes after SEQUENCE", len(rest))
+	}
+	return DecodeAll(e.Content)
+}
+
+func (e Element) Int() (int64, error) {
+	if len(e.Content) == 0 || len(e.Content) > 8 {
+		return 0, fmt.Errorf("ber: invalid integer length %d", len(e.Content))
+	}
+	v := int64(int8(e.Content[0]))
+	for _, b := range e.Content[1:] {
+		v = v<<8 | int64(b)
+	}
+	return v, nil
+}
+
+func (e Element) Bool() bool {
+	return len(e.Content) > 0 && e.Content[0] != 0
+}
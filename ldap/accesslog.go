@@ -0,0 +1,162 @@
+package ldap
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jsimonetti/ldapserv/filter"
+	ldap "github.com/lor00x/goldap/message"
+)
+
+// Access log formats
+const (
+	AccessLogText = "text"
+	AccessLogJSON = "json"
+)
+
+// AccessLog writes one line per operation with the connection and message
+// IDs, the operation and its target, the result code, the number of
+// entries returned, the duration and the address of the client, in the
+// spirit of the OpenLDAP stats log. Credentials are never written: bind
+// passwords and SASL credentials are left out and the values asserted on
+// password attributes in search filters are masked.
+type AccessLog struct {
+	mutex  sync.Mutex
+	w      io.Writer
+	format string
+}
+
+// NewAccessLog returns an access log writing to w in the text or JSON
+// format, the text format is used when format is unknown
+func NewAccessLog(w io.Writer, format string) *AccessLog {
+	if format != AccessLogJSON {
+		format = AccessLogText
+	}
+	return &AccessLog{w: w, format: format}
+}
+
+// accessRecord is a line of the access log
+type accessRecord struct {
+	Time      time.Time `json:"time"`
+	Conn      int       `json:"conn"`
+	Op        int       `json:"op"`
+	Operation string    `json:"operation"`
+	DN        string    `json:"dn,omitempty"`
+	Method    string    `json:"method,omitempty"`
+	Scope     *int      `json:"scope,omitempty"`
+	Filter    string    `json:"filter,omitempty"`
+	OID       string    `json:"oid,omitempty"`
+	Msg       *int      `json:"msg,omitempty"`
+	Result    *int      `json:"result,omitempty"`
+	Entries   *int      `json:"entries,omitempty"`
+	Duration  float64   `json:"duration_ms"`
+	Addr      string    `json:"addr"`
+}
+
+// passwordAssertion matches the values asserted on password attributes in
+// a filter string
+var passwordAssertion = regexp.MustCompile(`(?i)(\((?:userPassword|authPassword)[^=]*=)[^)]*`)
+
+// newAccessRecord describes the operation of a request
+func newAccessRecord(m *Message) *accessRecord {
+	rec := &accessRecord{
+		Time: time.Now(),
+		Conn: m.Client.ID(),
+		Op:   m.MessageID().Int(),
+		Addr: m.Client.RemoteAddr().String(),
+	}
+	switch r := m.ProtocolOp().(type) {
+	case ldap.BindRequest:
+		rec.Operation, rec.DN, rec.Method = "BIND", string(r.Name()), r.AuthenticationChoice()
+	case ldap.UnbindRequest:
+		rec.Operation = "UNBIND"
+	case ldap.SearchRequest:
+		scope := r.Scope().Int()
+		rec.Operation, rec.DN, rec.Scope = "SEARCH", string(r.BaseObject()), &scope
+		f, err := filter.Decompile(r.Filter())
+		if err != nil {
+			f = r.FilterString()
+		}
+		rec.Filter = passwordAssertion.ReplaceAllString(f, "$1***")
+	case ldap.ModifyRequest:
+		rec.Operation, rec.DN = "MODIFY", string(r.Object())
+	case ldap.AddRequest:
+		rec.Operation, rec.DN = "ADD", string(r.Entry())
+	case ldap.DelRequest:
+		rec.Operation, rec.DN = "DELETE", string(r)
+	case ldap.ModifyDNRequest:
+		rec.Operation = "MODRDN"
+		if req, err := ParseModifyDNRequest(m); err == nil {
+			rec.DN = req.Entry
+		}
+	case ldap.CompareRequest:
+		rec.Operation, rec.DN = "COMPARE", string(r.Entry())
+	case ldap.AbandonRequest:
+		msg := int(r)
+		rec.Operation, rec.Msg = "ABANDON", &msg
+	case ldap.ExtendedRequest:
+		rec.Operation, rec.OID = "EXTENDED", string(r.RequestName())
+	default:
+		rec.Operation = strings.ToUpper(m.ProtocolOpName())
+	}
+	return rec
+}
+
+// log writes the record of a processed request, result is nil when no
+// final response was sent
+func (a *AccessLog) log(m *Message, result *int, entries int, duration time.Duration) {
+	if a == nil {
+		return
+	}
+	rec := newAccessRecord(m)
+	rec.Result = result
+	if _, ok := m.ProtocolOp().(ldap.SearchRequest); ok {
+		rec.Entries = &entries
+	}
+	rec.Duration = float64(duration.Microseconds()) / 1000
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.format == AccessLogJSON {
+		json.NewEncoder(a.w).Encode(rec)
+		return
+	}
+	a.w.Write([]byte(rec.String() + "\n"))
+}
+
+// String formats the record as a line of the text access log
+func (rec *accessRecord) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s conn=%d op=%d %s", rec.Time.Format(time.RFC3339Nano), rec.Conn, rec.Op, rec.Operation)
+	if rec.DN != "" || rec.Operation == "SEARCH" || rec.Operation == "BIND" {
+		fmt.Fprintf(&b, " dn=%q", rec.DN)
+	}
+	if rec.Method != "" {
+		fmt.Fprintf(&b, " method=%s", rec.Method)
+	}
+	if rec.Scope != nil {
+		fmt.Fprintf(&b, " scope=%d", *rec.Scope)
+	}
+	if rec.Filter != "" {
+		fmt.Fprintf(&b, " filter=%q", rec.Filter)
+	}
+	if rec.OID != "" {
+		fmt.Fprintf(&b, " oid=%s", rec.OID)
+	}
+	if rec.Msg != nil {
+		fmt.Fprintf(&b, " msg=%d", *rec.Msg)
+	}
+	if rec.Result != nil {
+		fmt.Fprintf(&b, " result=%d", *rec.Result)
+	}
+	if rec.Entries != nil {
+		fmt.Fprintf(&b, " entries=%d", *rec.Entries)
+	}
+	fmt.Fprintf(&b, " duration=%.3fms addr=%s", rec.Duration, rec.Addr)
+	return b.String()
+}
@@ -0,0 +1,44 @@
+package ldap
+
+import (
+	"fmt"
+
+	"github.com/jsimonetti/ldapserv/internal/ber"
+	ldap "github.com/lor00x/goldap/message"
+)
+
+// encodeProtocolOp returns the BER element of a goldap ProtocolOp, it is
+// used to read fields goldap does not expose getters for
+func encodeProtocolOp(po ldap.ProtocolOp) (ber.Element, error) {
+	data, err := ldap.NewLDAPMessageWithProtocolOp(po).Write()
+	if err != nil {
+		return ber.Element{}, err
+	}
+	elements, err := ber.DecodeSequence(data.Bytes())
+	if err != nil {
+		return ber.Element{}, err
+	}
+	if len(elements) < 2 {
+		return ber.Element{}, fmt.Errorf("ber: invalid LDAPMessage encoding")
+	}
+	return elements[1], nil
+}
+
+// decodeProtocolOp builds a goldap ProtocolOp from its BER encoding, it is
+// used to build responses with fields goldap does not expose setters for
+func decodeProtocolOp(op []byte) (ldap.ProtocolOp, error) {
+	m, err := decodeMessage(ber.Sequence(ber.Integer(0), op))
+	if err != nil {
+		return nil, err
+	}
+	return m.ProtocolOp(), nil
+}
+
+// encodeLDAPResult encodes the components of an LDAPResult
+func encodeLDAPResult(resultCode int, matchedDN, diagnosticMessage string) []byte {
+	return ber.Concat(
+		ber.Enumerated(resultCode),
+		ber.OctetString([]byte(matchedDN)),
+		ber.OctetString([]byte(diagnosticMessage)),
+	)
+}
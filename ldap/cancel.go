@@ -0,0 +1,85 @@
+package ldap
+
+import (
+	"fmt"
+
+	"github.com/jsimonetti/ldapserv/internal/ber"
+	ldap "github.com/lor00x/goldap/message"
+)
+
+// HandleCancel answers a Cancel extended request. The canceled operation
+// ends with the canceled result code and the Cancel operation returns
+// once it has ended, with success, or with noSuchOperation, tooLate or
+// cannotCancel when the operation could not be canceled.
+// @see RFC https://tools.ietf.org/html/rfc3909
+func HandleCancel(w ResponseWriter, m *Message) {
+	id, err := parseCancelRequest(m)
+	if err != nil {
+		res := NewExtendedResponse(LDAPResultProtocolError)
+		res.SetDiagnosticMessage(err.Error())
+		w.Write(res)
+		return
+	}
+
+	target, ok := m.Client.GetMessageByID(id)
+	if !ok {
+		res := NewExtendedResponse(LDAPResultNoSuchOperation)
+		res.SetDiagnosticMessage(fmt.Sprintf("no outstanding operation with message ID %d", id))
+		w.Write(res)
+		return
+	}
+	if !cancelable(target) {
+		res := NewExtendedResponse(LDAPResultCannotCancel)
+		res.SetDiagnosticMessage(fmt.Sprintf("%s can not be canceled", target.ProtocolOpName()))
+		w.Write(res)
+		return
+	}
+	if !target.cancelRequest() {
+		w.Write(NewExtendedResponse(LDAPResultTooLate))
+		return
+	}
+
+	// the Cancel response is sent after the response of the canceled
+	// operation
+	<-target.finished
+	w.Write(NewExtendedResponse(LDAPResultSuccess))
+}
+
+// parseCancelRequest returns the message ID of the operation to cancel
+//
+//	cancelRequestValue ::= SEQUENCE {
+//	        cancelID        MessageID }
+func parseCancelRequest(m *Message) (int, error) {
+	r := m.GetExtendedRequest()
+	value := r.RequestValue()
+	if value == nil {
+		return 0, fmt.Errorf("missing cancel request value")
+	}
+	elements, err := ber.DecodeSequence([]byte(*value))
+	if err != nil {
+		return 0, err
+	}
+	if len(elements) != 1 || elements[0].Tag != ber.TagInteger {
+		return 0, fmt.Errorf("invalid cancel request value")
+	}
+	id, err := elements[0].Int()
+	if err != nil || id < 0 || id > 1<<31-1 {
+		return 0, fmt.Errorf("invalid cancel request message ID")
+	}
+	return int(id), nil
+}
+
+// cancelable returns false for the operations RFC 3909 excludes: Abandon,
+// Bind, Unbind, Cancel and StartTLS
+func cancelable(m *Message) bool {
+	switch op := m.ProtocolOp().(type) {
+	case ldap.AbandonRequest, ldap.BindRequest, ldap.UnbindRequest:
+		return false
+	case ldap.ExtendedRequest:
+		switch op.RequestName() {
+		case NoticeOfCancel, NoticeOfStartTLS:
+			return false
+		}
+	}
+	return true
+}
@@ -2,8 +2,10 @@ package ldap
 
 import (
 	"bufio"
+	"context"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	ldap "github.com/lor00x/goldap/message"
@@ -11,45 +13,54 @@ import (
 )
 
 type client struct {
-	Numero      int
-	srv         *Server
-	rwc         net.Conn
-	br          *bufio.Reader
-	bw          *bufio.Writer
-	chanOut     chan *ldap.LDAPMessage
-	wg          sync.WaitGroup
-	closing     chan bool
-	requestList map[int]*Message
-	mutex       sync.Mutex
-	writeDone   chan bool
-	log         log.Logger
+	Numero        int
+	srv           *Server
+	rwc           net.Conn
+	br            *bufio.Reader
+	bw            *bufio.Writer
+	chanOut       chan *outgoingMessage
+	wg            sync.WaitGroup
+	closing       chan bool
+	requestList   map[int]*Message
+	pagedSearches []*pagedSearch
+	session       *Session
+	mutex         sync.Mutex
+	connMutex     sync.Mutex // guards rwc and bw, see startTLS
+	running       int32      // number of requests in progress
+	writeDone     chan bool
+	log           log.Logger
+	// ctx is the parent of the contexts of the requests, it is canceled
+	// when the client disconnects
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func (c *client) GetConn() net.Conn {
+	c.connMutex.Lock()
+	defer c.connMutex.Unlock()
 	return c.rwc
 }
 
-func (c *client) SetConn(conn net.Conn) {
-	c.rwc = conn
-	c.br = bufio.NewReader(c.rwc)
-	c.bw = bufio.NewWriter(c.rwc)
-}
-
 func (c *client) GetMessageByID(messageID int) (*Message, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	if requestToAbandon, ok := c.requestList[messageID]; ok {
 		return requestToAbandon, true
 	}
 	return nil, false
 }
 
-func (c *client) Addr() net.Addr {
-	return c.rwc.RemoteAddr()
-}
-
 func (c *client) serve() {
 	defer c.close()
 
+	// the address is the one of the real client when the listener reads a
+	// PROXY protocol header, see ProxyProtocol
+	c.log = c.log.New(log.Ctx{"addr": c.rwc.RemoteAddr().String()})
+	c.log.Debug("Connection client accepted")
+
 	c.closing = make(chan bool)
+	c.ctx, c.cancel = context.WithCancel(c.srv.ctx)
+	maxPDUSize := func() int { return c.srv.maxPDUSize(c.session.IsAnonymous()) }
 	if onc := c.srv.OnNewConnection; onc != nil {
 		if err := onc(c.rwc); err != nil {
 			c.log.Debug("newconn error", log.Ctx{"error": err})
@@ -60,12 +71,15 @@ func (c *client) serve() {
 	// Create the ldap response queue to be writted to client (buffered to 20)
 	// buffered to 20 means that If client is slow to handler responses, Server
 	// Handlers will stop to send more respones
-	c.chanOut = make(chan *ldap.LDAPMessage)
+	c.chanOut = make(chan *outgoingMessage)
 	c.writeDone = make(chan bool)
 	// for each message in c.chanOut send it to client
 	go func() {
 		for msg := range c.chanOut {
-			c.writeMessage(msg)
+			err := c.writeMessage(msg)
+			if msg.written != nil {
+				msg.written <- err
+			}
 		}
 		close(c.writeDone)
 	}()
@@ -76,15 +90,9 @@ func (c *client) serve() {
 			select {
 			case <-c.srv.chDone: // server signals shutdown process
 				c.wg.Add(1)
-				r := NewExtendedResponse(LDAPResultUnwillingToPerform)
-				r.SetDiagnosticMessage("server is about to stop")
-				r.SetResponseName(NoticeOfDisconnection)
-
-				m := ldap.NewLDAPMessageWithProtocolOp(r)
-
-				c.chanOut <- m
+				c.disconnect(LDAPResultUnwillingToPerform, "server is about to stop")
 				c.wg.Done()
-				c.rwc.SetReadDeadline(time.Now().Add(time.Millisecond))
+				c.GetConn().SetReadDeadline(time.Now().Add(time.Millisecond))
 				return
 			case <-c.closing:
 				return
@@ -104,11 +112,19 @@ func (c *client) serve() {
 		}
 
 		//Read client input as a ASN1/BER binary message
-		messagePacket, err := readMessagePacket(c.br)
+		messagePacket, err := readMessagePacket(c.br, maxPDUSize)
 		if err != nil {
-			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
-				c.log.Debug("client timeout", log.Ctx{"clientnum": c.Numero, "error": err})
-			} else {
+			switch err := err.(type) {
+			case ldap.SyntaxError, ldap.StructuralError:
+				c.log.Info("malformed message", log.Ctx{"error": err})
+				c.disconnect(LDAPResultProtocolError, err.Error())
+			case *net.OpError:
+				if err.Timeout() {
+					c.log.Debug("client timeout", log.Ctx{"clientnum": c.Numero, "error": err})
+					break
+				}
+				c.log.Debug("Error readMessagePacket", log.Ctx{"error": err})
+			default:
 				c.log.Debug("Error readMessagePacket", log.Ctx{"error": err})
 			}
 			return
@@ -118,18 +134,20 @@ func (c *client) serve() {
 		message, err := messagePacket.readMessage()
 
 		if err != nil {
-			c.log.Debug("Error reading Message", log.Ctx{"error": err.Error()})
-			continue
+			c.log.Info("malformed message", log.Ctx{"opname": messagePacket.opName(), "size": len(messagePacket.bytes), "error": err.Error()})
+			c.disconnect(LDAPResultProtocolError, "malformed message")
+			return
 		}
-		c.log.Debug("incoming packet", log.Ctx{"opname": message.ProtocolOpName(), "packet": messagePacket})
-
-		// TODO: Use a implementation to limit runnuning request by client
-		// solution 1 : when the buffered output channel is full, send a busy
-		// solution 2 : when 10 client requests (goroutines) are running, send a busy message
-		// And when the limit is reached THEN send a BusyLdapMessage
+		if carriesCredentials(message.ProtocolOp()) {
+			c.log.Debug("incoming packet", log.Ctx{"opname": message.ProtocolOpName(), "size": len(messagePacket.bytes)})
+		} else {
+			c.log.Debug("incoming packet", log.Ctx{"opname": message.ProtocolOpName(), "packet": messagePacket})
+		}
+		c.srv.bytesReceived.Add(float64(len(messagePacket.bytes)))
 
 		// When message is an UnbindRequest, stop serving
 		if _, ok := message.ProtocolOp().(ldap.UnbindRequest); ok {
+			c.srv.AccessLog.log(&Message{LDAPMessage: &message, Client: c.session}, nil, 0, 0)
 			return
 		}
 
@@ -138,20 +156,34 @@ func (c *client) serve() {
 		// @see RFC https://tools.ietf.org/html/rfc4511#section-4.14.1
 		if req, ok := message.ProtocolOp().(ldap.ExtendedRequest); ok {
 			if req.RequestName() == NoticeOfStartTLS {
-				c.wg.Add(1)
-				c.ProcessRequestMessage(&message)
+				if err := c.startTLS(&message); err != nil {
+					return
+				}
 				continue
 			}
 		}
 
 		// TODO: go/non go routine choice should be done in the ProcessRequestMessage
 		// not in the client.serve func
+		if !c.acquire(&message) {
+			continue
+		}
 		c.wg.Add(1)
 		go c.ProcessRequestMessage(&message)
 	}
 
 }
 
+// disconnect sends a notice of disconnection, the connection is closed
+// once the client stops being served
+// @see RFC https://tools.ietf.org/html/rfc4511#section-4.4.1
+func (c *client) disconnect(resultCode int, diagnosticMessage string) {
+	r := NewExtendedResponse(resultCode)
+	r.SetDiagnosticMessage(diagnosticMessage)
+	r.SetResponseName(NoticeOfDisconnection)
+	c.chanOut <- &outgoingMessage{LDAPMessage: ldap.NewLDAPMessageWithProtocolOp(r)}
+}
+
 // close closes client,
 // * stop reading from client
 // * signals to all currently running request processor to stop
@@ -167,12 +199,7 @@ func (c *client) close() {
 	c.log.Debug("client close - stop reading from client")
 
 	// signals to all currently running request processor to stop
-	c.mutex.Lock()
-	for messageID, request := range c.requestList {
-		c.log.Debug("Client close() - sent abandon signal to request", log.Ctx{"messageid": messageID})
-		go request.Abandon()
-	}
-	c.mutex.Unlock()
+	c.cancel()
 	c.log.Debug("client close() - Abandon signal sent to processors")
 
 	c.wg.Wait()      // wait for all current running request processor to end
@@ -183,14 +210,57 @@ func (c *client) close() {
 	c.rwc.Close() // close client connection
 	c.log.Debug("client connection closed")
 
+	atomic.AddInt32(&c.srv.connections, -1)
 	c.srv.wg.Done() // signal to server that client shutdown is ok
 }
 
-func (c *client) writeMessage(m *ldap.LDAPMessage) {
-	data, _ := m.Write()
-	c.log.Debug("outgoing packet", log.Ctx{"opname": m.ProtocolOpName(), "data": data.Bytes()})
-	c.bw.Write(data.Bytes())
-	c.bw.Flush()
+// outgoingMessage is a message queued to be written to the client
+type outgoingMessage struct {
+	*ldap.LDAPMessage
+	controls []Control
+	// written, if non-nil, receives the result of the write once the
+	// message is flushed to the connection
+	written chan error
+}
+
+func (c *client) writeMessage(m *outgoingMessage) error {
+	data, err := m.Write()
+	if err != nil {
+		c.log.Error("unable to encode message", log.Ctx{"opname": m.ProtocolOpName(), "error": err})
+		return err
+	}
+	bytes := data.Bytes()
+	if len(m.controls) > 0 {
+		if bytes, err = appendControls(bytes, m.controls); err != nil {
+			c.log.Error("unable to attach response controls", log.Ctx{"error": err})
+			bytes = data.Bytes()
+		}
+	}
+	if carriesCredentials(m.ProtocolOp()) {
+		c.log.Debug("outgoing packet", log.Ctx{"opname": m.ProtocolOpName(), "size": len(bytes)})
+	} else {
+		c.log.Debug("outgoing packet", log.Ctx{"opname": m.ProtocolOpName(), "data": bytes})
+	}
+	c.srv.bytesSent.Add(float64(len(bytes)))
+	c.connMutex.Lock()
+	defer c.connMutex.Unlock()
+	c.bw.Write(bytes)
+	return c.bw.Flush()
+}
+
+// carriesCredentials returns true for the messages which may hold
+// passwords or SASL credentials, their content is never logged
+func carriesCredentials(po ldap.ProtocolOp) bool {
+	switch op := po.(type) {
+	case ldap.BindRequest, ldap.BindResponse:
+		return true
+	case ldap.ExtendedRequest:
+		return op.RequestName() == NoticeOfPasswordModify
+	case ldap.ExtendedResponse:
+		// a password modify response holds the generated password
+		return true
+	}
+	return false
 }
 
 // ResponseWriter interface is used by an LDAP handler to
@@ -198,37 +268,131 @@ func (c *client) writeMessage(m *ldap.LDAPMessage) {
 type ResponseWriter interface {
 	// Write writes the LDAPResponse to the connection as part of an LDAP reply.
 	Write(po ldap.ProtocolOp)
+	// AddControl attaches a control to the final response of the operation.
+	AddControl(c Control)
 }
 
 type responseWriterImpl struct {
-	chanOut   chan *ldap.LDAPMessage
+	chanOut   chan *outgoingMessage
 	messageID int
+	request   *Message
+	controls  []Control
+	// result is the result code of the final response and entries the
+	// number of entries returned, for the metrics and the access log
+	result  *int
+	entries int
 }
 
-func (w responseWriterImpl) Write(po ldap.ProtocolOp) {
-	m := ldap.NewLDAPMessageWithProtocolOp(po)
+func (w *responseWriterImpl) Write(po ldap.ProtocolOp) {
+	if !w.request.beforeWrite(po) {
+		return
+	}
+
+	m := &outgoingMessage{LDAPMessage: ldap.NewLDAPMessageWithProtocolOp(po)}
 	m.SetMessageID(w.messageID)
+
+	if isFinalResponse(po) {
+		m.controls = w.controls
+		w.controls = nil
+		if code, ok := ResultCode(po); ok {
+			w.result = &code
+		}
+	}
+	if _, ok := po.(ldap.SearchResultEntry); ok {
+		w.entries++
+	}
+
+	// a successful simple bind sets the identity of the session, SASL
+	// binds are recorded by HandleSASLBind
+	if _, ok := po.(ldap.BindResponse); ok {
+		req, ok := w.request.ProtocolOp().(ldap.BindRequest)
+		if code, _ := ResultCode(po); ok && code == LDAPResultSuccess && req.AuthenticationChoice() == "simple" {
+			w.request.Client.bindSimple(string(req.Name()))
+		}
+	}
 	w.chanOut <- m
 }
 
+func (w *responseWriterImpl) AddControl(c Control) {
+	w.controls = append(w.controls, c)
+}
+
+// isFinalResponse returns false for the responses which can be sent
+// several times for a single request
+func isFinalResponse(po ldap.ProtocolOp) bool {
+	switch po.(type) {
+	case ldap.SearchResultEntry, ldap.SearchResultReference, ldap.IntermediateResponse:
+		return false
+	}
+	return true
+}
+
 func (c *client) ProcessRequestMessage(message *ldap.LDAPMessage) {
 	defer c.wg.Done()
+	defer c.release()
 
 	var m Message
 	m = Message{
 		LDAPMessage: message,
-		Done:        make(chan bool, 2),
-		Client:      c,
+		Client:      c.session,
+		controls:    parseControls(message.Controls()),
+		finished:    make(chan struct{}),
 	}
+	m.ctx, m.cancel = c.requestContext(message)
+	defer m.cancel()
 
 	c.registerRequest(&m)
 	defer c.unregisterRequest(&m)
 
-	var w responseWriterImpl
-	w.chanOut = c.chanOut
-	w.messageID = m.MessageID().Int()
+	switch req := message.ProtocolOp().(type) {
+	case ldap.AbandonRequest:
+		// abandoning the last page of a paged search invalidates its cookie
+		c.abandonPagedSearch(int(req))
+	case ldap.BindRequest:
+		c.session.resetBind(req)
+	}
+
+	w := &responseWriterImpl{
+		chanOut:   c.chanOut,
+		messageID: m.MessageID().Int(),
+		request:   &m,
+	}
+
+	start := time.Now()
+	defer func() {
+		duration := time.Since(start)
+		c.srv.observeOperation(&m, w.result, duration)
+		c.srv.AccessLog.log(&m, w.result, w.entries, duration)
+	}()
 
 	c.srv.Handler.ServeLDAP(w, &m)
+
+	// a canceled request ends with the canceled result code, whether its
+	// handler stopped early or not
+	// @see RFC https://tools.ietf.org/html/rfc3909#section-2
+	if m.Canceled() {
+		if res := NewResponseForRequest(&m, LDAPResultCanceled, "operation canceled"); res != nil {
+			w.Write(res)
+		}
+		return
+	}
+
+	// a handler stopped by the time limit without answering
+	if m.ctx.Err() == context.DeadlineExceeded && !m.hasResponded() {
+		if res := NewResponseForRequest(&m, LDAPResultTimeLimitExceeded, "time limit exceeded"); res != nil {
+			w.Write(res)
+		}
+	}
+}
+
+// requestContext returns the context of a request, the context of a search
+// with a time limit expires once the limit is reached
+// @see RFC https://tools.ietf.org/html/rfc4511#section-4.5.1.5
+func (c *client) requestContext(message *ldap.LDAPMessage) (context.Context, context.CancelFunc) {
+	if r, ok := message.ProtocolOp().(ldap.SearchRequest); ok && r.TimeLimit().Int() > 0 {
+		return context.WithTimeout(c.ctx, time.Duration(r.TimeLimit().Int())*time.Second)
+	}
+	return context.WithCancel(c.ctx)
 }
 
 func (c *client) registerRequest(m *Message) {
@@ -241,4 +405,5 @@ func (c *client) unregisterRequest(m *Message) {
 	c.mutex.Lock()
 	delete(c.requestList, m.MessageID().Int())
 	c.mutex.Unlock()
+	close(m.finished)
 }
@@ -65,8 +65,14 @@ const (
 	LDAPResultNotAllowedOnRDN              = 67
 	LDAPResultEntryAlreadyExists           = 68
 	LDAPResultObjectClassModsProhibited    = 69
+	LDAPResultSortControlMissing           = 60
+	LDAPResultOffsetRangeError             = 61
 	LDAPResultAffectsMultipleDSAs          = 71
 	LDAPResultOther                        = 80
+	LDAPResultCanceled                     = 118
+	LDAPResultNoSuchOperation              = 119
+	LDAPResultTooLate                      = 120
+	LDAPResultCannotCancel                 = 121
 
 	ErrorNetwork         = 200
 	ErrorFilterCompile   = 201
@@ -0,0 +1,80 @@
+package ldap
+
+import (
+	"fmt"
+
+	"github.com/jsimonetti/ldapserv/internal/ber"
+	ldap "github.com/lor00x/goldap/message"
+)
+
+// Control is a request or response control
+// @see RFC https://tools.ietf.org/html/rfc4511#section-4.1.11
+type Control struct {
+	OID         string
+	Criticality bool
+	// Value is nil when the control has no controlValue
+	Value []byte
+}
+
+// NewControl returns a Control
+func NewControl(oid string, criticality bool, value []byte) Control {
+	return Control{
+		OID:         oid,
+		Criticality: criticality,
+		Value:       value,
+	}
+}
+
+func (c Control) String() string {
+	return fmt.Sprintf("Control{OID=%s, Criticality=%t, Value=%x}", c.OID, c.Criticality, c.Value)
+}
+
+// encode returns the BER encoding of the control
+func (c Control) encode() []byte {
+	elements := [][]byte{ber.OctetString([]byte(c.OID))}
+	// criticality DEFAULT FALSE must not be encoded when false
+	if c.Criticality {
+		elements = append(elements, ber.Boolean(true))
+	}
+	if c.Value != nil {
+		elements = append(elements, ber.OctetString(c.Value))
+	}
+	return ber.Sequence(elements...)
+}
+
+// parseControls converts the goldap request controls
+func parseControls(controls *ldap.Controls) []Control {
+	if controls == nil {
+		return nil
+	}
+	ret := make([]Control, 0, len(*controls))
+	for _, c := range *controls {
+		control := Control{
+			OID:         string(c.ControlType()),
+			Criticality: c.Criticality().Bool(),
+		}
+		if v := c.ControlValue(); v != nil {
+			control.Value = []byte(*v)
+		}
+		ret = append(ret, control)
+	}
+	return ret
+}
+
+// appendControls adds the encoded controls to the encoded LDAPMessage
+func appendControls(message []byte, controls []Control) ([]byte, error) {
+	e, rest, err := ber.Decode(message)
+	if err != nil {
+		return nil, err
+	}
+	if e.Tag != ber.TagSequence || len(rest) != 0 {
+		return nil, fmt.Errorf("invalid LDAPMessage encoding")
+	}
+
+	var encoded []byte
+	for _, c := range controls {
+		encoded = append(encoded, c.encode()...)
+	}
+	content := ber.Concat(e.Content, ber.Encode(ber.ClassContext|ber.Constructed|ldap.TagLDAPMessageControls, encoded))
+	return ber.Encode(ber.TagSequence, content), nil
+}
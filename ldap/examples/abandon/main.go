@@ -42,7 +42,7 @@ func handleSearch(w ldap.ResponseWriter, m *ldap.Message) {
 	// Handle Stop Signal (server stop / client disconnected / Abandoned request....)
 	for {
 		select {
-		case <-m.Done:
+		case <-m.Context().Done():
 			log.Printf("Leaving handleSearch... for msgid=%d", m.MessageID)
 			return
 		default:
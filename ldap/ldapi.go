@@ -0,0 +1,47 @@
+package ldap
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// PeerCred is the identity of the process at the other end of a Unix
+// domain socket, as reported by the kernel
+type PeerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// DN returns the identity of the peer used by SASL EXTERNAL binds
+func (p *PeerCred) DN() string {
+	return fmt.Sprintf("gidNumber=%d+uidNumber=%d,cn=peercred,cn=external,cn=auth", p.GID, p.UID)
+}
+
+// ListenAndServeUnix listens on the Unix domain socket path for ldapi://
+// connections. A stale socket left by a previous run is removed, the
+// socket is removed when the listener is closed. The credentials of the
+// peers are available to the handlers and to SASL EXTERNAL binds.
+func (s *Server) ListenAndServeUnix(path string, options ...func(*Server)) error {
+
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		// a socket nobody listens on refuses the connection
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			os.Remove(path)
+		} else {
+			conn.Close()
+		}
+	}
+
+	ln, e := net.Listen("unix", path)
+	if e != nil {
+		return e
+	}
+	s.log.Debug("Listening", log.Ctx{"path": path})
+
+	return s.serve(s.setListener(ln, options, nil))
+}
@@ -0,0 +1,73 @@
+package ldap
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestListenAndServeUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ldapi")
+
+	// a socket left behind by a previous run
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	if _, err := os.Lstat(path); err != nil {
+		t.Fatalf("stale socket: %s", err)
+	}
+
+	peers := make(chan *PeerCred, 1)
+	s := newTestServer(func(w ResponseWriter, m *Message) {
+		peers <- m.Client.PeerCred()
+		w.Write(NewSearchResultDoneResponse(LDAPResultSuccess))
+	})
+	errc := make(chan error, 1)
+	go func() { errc <- s.ListenAndServeUnix(path) }()
+	t.Cleanup(func() { stopTestServer(t, s) })
+
+	// the stale socket refuses the connections until it is replaced
+	var c *testConn
+	for deadline := time.Now().Add(5 * time.Second); c == nil; {
+		select {
+		case err := <-errc:
+			t.Fatalf("ListenAndServeUnix: %v", err)
+		default:
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			c = dialTest(t, "unix", path)
+		} else if time.Now().After(deadline) {
+			t.Fatalf("the stale socket was not replaced: %s", err)
+		} else {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	c.search(1, "")
+	if _, code := c.readResult(); code != LDAPResultSuccess {
+		t.Fatalf("got result %d, want success", code)
+	}
+	peer := <-peers
+	if runtime.GOOS != "linux" {
+		return
+	}
+	if peer == nil {
+		t.Fatal("the peer credentials are missing")
+	}
+	if int(peer.PID) != os.Getpid() || int(peer.UID) != os.Getuid() || int(peer.GID) != os.Getgid() {
+		t.Errorf("got peer %+v, want pid %d uid %d gid %d", *peer, os.Getpid(), os.Getuid(), os.Getgid())
+	}
+
+	// a socket in use is not replaced, the connection probing it is closed
+	other := newTestServer(func(w ResponseWriter, m *Message) {})
+	if err := other.ListenAndServeUnix(path); err == nil {
+		t.Error("ListenAndServeUnix replaced a socket in use")
+	}
+}
@@ -0,0 +1,68 @@
+package ldap
+
+import (
+	"sync/atomic"
+
+	ldap "github.com/lor00x/goldap/message"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// ServerStats is a snapshot of the activity of the server
+type ServerStats struct {
+	Connections   int    // connections currently open
+	Accepted      int    // connections accepted since the start
+	Requests      int    // operations in progress
+	BusyResponses uint64 // requests refused because a limit was reached
+
+	MaxRequests          int // server wide limit, 0 when unlimited
+	MaxRequestsPerClient int // per connection limit, 0 when unlimited
+}
+
+// Stats returns the current activity of the server
+func (s *Server) Stats() ServerStats {
+	return ServerStats{
+		Connections:          int(atomic.LoadInt32(&s.connections)),
+		Accepted:             int(atomic.LoadInt32(&s.clients)),
+		Requests:             int(atomic.LoadInt32(&s.running)),
+		BusyResponses:        atomic.LoadUint64(&s.busy),
+		MaxRequests:          s.MaxRequests,
+		MaxRequestsPerClient: s.MaxRequestsPerClient,
+	}
+}
+
+// acquire reserves a slot for the request within the per connection and
+// the server wide limits. When a limit is reached the request is answered
+// with busy and false is returned, a client flooding its connection only
+// gets busy responses while the others are still served.
+func (c *client) acquire(message *ldap.LDAPMessage) bool {
+	running := atomic.AddInt32(&c.running, 1)
+	total := atomic.AddInt32(&c.srv.running, 1)
+
+	// an abandon request has no response and frees a slot
+	if _, ok := message.ProtocolOp().(ldap.AbandonRequest); ok {
+		return true
+	}
+
+	perClient, serverWide := c.srv.MaxRequestsPerClient, c.srv.MaxRequests
+	if (perClient <= 0 || int(running) <= perClient) && (serverWide <= 0 || int(total) <= serverWide) {
+		return true
+	}
+	c.release()
+	atomic.AddUint64(&c.srv.busy, 1)
+	c.log.Info("too many operations in progress", log.Ctx{"opname": message.ProtocolOpName(), "running": running, "total": total})
+
+	res := NewResponseForRequest(&Message{LDAPMessage: message}, LDAPResultBusy, "too many operations in progress")
+	if res == nil {
+		return false
+	}
+	m := &outgoingMessage{LDAPMessage: ldap.NewLDAPMessageWithProtocolOp(res)}
+	m.SetMessageID(message.MessageID().Int())
+	c.chanOut <- m
+	return false
+}
+
+// release frees the slot of a request once processed
+func (c *client) release() {
+	atomic.AddInt32(&c.running, -1)
+	atomic.AddInt32(&c.srv.running, -1)
+}
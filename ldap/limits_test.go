@@ -0,0 +1,120 @@
+package ldap
+
+import (
+	"testing"
+	"time"
+
+	ldap "github.com/lor00x/goldap/message"
+)
+
+// newLimitsTestServer returns a server whose searches of cn=flood stay in
+// progress until release is closed, the abandon requests cancel the
+// search they target
+func newLimitsTestServer(release chan struct{}) *Server {
+	return newTestServer(func(w ResponseWriter, m *Message) {
+		switch req := m.ProtocolOp().(type) {
+		case ldap.AbandonRequest:
+			if target, ok := m.Client.GetMessageByID(int(req)); ok {
+				target.Abandon()
+			}
+			return
+		case ldap.SearchRequest:
+			if string(req.BaseObject()) == "cn=flood" {
+				select {
+				case <-release:
+				case <-m.Context().Done():
+					return
+				}
+			}
+		}
+		w.Write(NewSearchResultDoneResponse(LDAPResultSuccess))
+	})
+}
+
+// waitRequests waits for the server to have n requests in progress
+func waitRequests(t *testing.T, s *Server, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); s.Stats().Requests != n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d requests in progress, want %d", s.Stats().Requests, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMaxRequestsPerClient(t *testing.T) {
+	release := make(chan struct{})
+	s := newLimitsTestServer(release)
+	s.MaxRequestsPerClient = 2
+	addr := serveTCP(t, s)
+	defer close(release)
+
+	flooder := dialTest(t, "tcp", addr)
+	for id := 1; id <= 5; id++ {
+		flooder.search(id, "cn=flood")
+	}
+	// the searches beyond the limit are answered right away
+	for id := 3; id <= 5; id++ {
+		gotID, code := flooder.readResult()
+		if gotID != id || code != LDAPResultBusy {
+			t.Errorf("flooder got message %d with result %d, want message %d with busy", gotID, code, id)
+		}
+	}
+
+	other := dialTest(t, "tcp", addr)
+	other.search(1, "cn=other")
+	if _, code := other.readResult(); code != LDAPResultSuccess {
+		t.Errorf("second connection got result %d, want success", code)
+	}
+
+	if busy := s.Stats().BusyResponses; busy != 3 {
+		t.Errorf("got %d busy responses, want 3", busy)
+	}
+}
+
+func TestMaxRequests(t *testing.T) {
+	release := make(chan struct{})
+	s := newLimitsTestServer(release)
+	s.MaxRequests = 3
+	addr := serveTCP(t, s)
+
+	first, second := dialTest(t, "tcp", addr), dialTest(t, "tcp", addr)
+	first.search(1, "cn=flood")
+	first.search(2, "cn=flood")
+	waitRequests(t, s, 2)
+	second.search(1, "cn=flood")
+	waitRequests(t, s, 3)
+
+	// both connections are over the server wide limit
+	second.search(2, "cn=flood")
+	if id, code := second.readResult(); id != 2 || code != LDAPResultBusy {
+		t.Errorf("second connection got message %d with result %d, want message 2 with busy", id, code)
+	}
+	first.search(3, "cn=other")
+	if id, code := first.readResult(); id != 3 || code != LDAPResultBusy {
+		t.Errorf("first connection got message %d with result %d, want message 3 with busy", id, code)
+	}
+	if stats := s.Stats(); stats.Requests != 3 || stats.BusyResponses != 2 {
+		t.Errorf("got %d requests and %d busy responses, want 3 and 2", stats.Requests, stats.BusyResponses)
+	}
+
+	// an abandon request is accepted over the limit and frees the slot of
+	// the search it abandons
+	second.abandon(3, 1)
+	waitRequests(t, s, 2)
+	second.search(4, "cn=other")
+	if id, code := second.readResult(); id != 4 || code != LDAPResultSuccess {
+		t.Errorf("second connection got message %d with result %d, want message 4 with success", id, code)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if _, code := first.readResult(); code != LDAPResultSuccess {
+			t.Errorf("first connection got result %d, want success", code)
+		}
+	}
+	waitRequests(t, s, 0)
+	if busy := s.Stats().BusyResponses; busy != 2 {
+		t.Errorf("got %d busy responses, want 2", busy)
+	}
+}
@@ -1,25 +1,128 @@
 package ldap
 
 import (
+	"context"
 	"fmt"
+	"sync"
 
 	ldap "github.com/lor00x/goldap/message"
 )
 
 type Message struct {
 	*ldap.LDAPMessage
-	Client *client
-	Done   chan bool
+	Client   *Session
+	controls []Control
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// mutex protects canceled, responded and result
+	mutex     sync.Mutex
+	canceled  bool
+	responded bool
+	result    *int
+	// finished is closed once the request processing ends
+	finished chan struct{}
+	// route is the label of the route serving the request, for the metrics
+	route string
 }
 
 func (m *Message) String() string {
 	return fmt.Sprintf("MessageId=%d, %s", m.MessageID(), m.ProtocolOpName())
 }
 
-// Abandon close the Done channel, to notify handler's user function to stop any
-// running process
+// Context returns the context of the request. It is canceled when the
+// request is abandoned or canceled, when the client disconnects and when
+// the server stops, the context of a search with a time limit has the
+// matching deadline. Handlers should stop processing once it is done.
+func (m *Message) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+// Abandon cancels the context of the request, to notify handler's user
+// function to stop any running process
 func (m *Message) Abandon() {
-	m.Done <- true
+	if m.cancel != nil {
+		m.cancel()
+	}
+}
+
+// cancelRequest marks the request as canceled and signals its handler to
+// stop, it returns false when the final response was already sent
+func (m *Message) cancelRequest() bool {
+	m.mutex.Lock()
+	if m.responded {
+		m.mutex.Unlock()
+		return false
+	}
+	m.canceled = true
+	m.mutex.Unlock()
+	m.Abandon()
+	return true
+}
+
+// hasResponded returns true once the final response was sent
+func (m *Message) hasResponded() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.responded
+}
+
+// beforeWrite records the final response of the request, it returns false
+// when the response must not be sent: once the request is canceled, only a
+// single response with the canceled result code is sent
+func (m *Message) beforeWrite(po ldap.ProtocolOp) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.canceled {
+		if code, ok := ResultCode(po); m.responded || !ok || code != LDAPResultCanceled {
+			return false
+		}
+	}
+	if isFinalResponse(po) {
+		m.responded = true
+		if code, ok := ResultCode(po); ok {
+			m.result = &code
+		}
+	}
+	return true
+}
+
+// Result returns the result code of the final response sent for the
+// request, false while none was sent
+func (m *Message) Result() (int, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.result == nil {
+		return 0, false
+	}
+	return *m.result, true
+}
+
+// Canceled returns true once the request was canceled by a Cancel
+// extended operation
+func (m *Message) Canceled() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.canceled
+}
+
+// RequestControls returns the controls sent by the client along with the request
+func (m *Message) RequestControls() []Control {
+	return m.controls
+}
+
+// GetControl returns the request control identified by oid
+func (m *Message) GetControl(oid string) (Control, bool) {
+	for _, c := range m.controls {
+		if c.OID == oid {
+			return c, true
+		}
+	}
+	return Control{}, false
 }
 
 func (m *Message) GetAbandonRequest() ldap.AbandonRequest {
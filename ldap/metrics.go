@@ -0,0 +1,365 @@
+package ldap
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// DefaultDurationBuckets are the upper bounds, in seconds, of the buckets
+// of the operation duration histogram
+var DefaultDurationBuckets = []float64{.0005, .001, .005, .01, .05, .1, .5, 1, 5, 10}
+
+// Metrics is a registry of counters, gauges and histograms exposed in the
+// Prometheus text format. The server records the connections, operations
+// and bytes exchanged, backends can add their own metrics, ie the number
+// of entries they hold. The methods are no-ops on a nil *Metrics.
+// @see https://prometheus.io/docs/instrumenting/exposition_formats/
+type Metrics struct {
+	mutex    sync.Mutex
+	families map[string]*metricFamily
+}
+
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	buckets []float64
+	series  map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labels string
+	value  float64
+	fn     func() float64
+	counts []uint64
+	count  uint64
+}
+
+// NewMetrics returns an empty registry
+func NewMetrics() *Metrics {
+	return &Metrics{families: make(map[string]*metricFamily)}
+}
+
+// Counter is a value which only goes up
+type Counter struct {
+	m *Metrics
+	s *metricSeries
+}
+
+// Counter returns the counter name with the labels, given as name and
+// value pairs. It is created on first use.
+func (m *Metrics) Counter(name, help string, labels ...string) *Counter {
+	if m == nil {
+		return nil
+	}
+	return &Counter{m: m, s: m.series(name, help, "counter", nil, labels)}
+}
+
+// Add adds v to the counter, v must not be negative
+func (c *Counter) Add(v float64) {
+	if c == nil || v < 0 {
+		return
+	}
+	c.m.mutex.Lock()
+	c.s.value += v
+	c.m.mutex.Unlock()
+}
+
+// Inc adds one to the counter
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Gauge is a value which goes up and down
+type Gauge struct {
+	m *Metrics
+	s *metricSeries
+}
+
+// Gauge returns the gauge name with the labels, given as name and value
+// pairs. It is created on first use.
+func (m *Metrics) Gauge(name, help string, labels ...string) *Gauge {
+	if m == nil {
+		return nil
+	}
+	return &Gauge{m: m, s: m.series(name, help, "gauge", nil, labels)}
+}
+
+// Set sets the value of the gauge
+func (g *Gauge) Set(v float64) {
+	if g == nil {
+		return
+	}
+	g.m.mutex.Lock()
+	g.s.value = v
+	g.m.mutex.Unlock()
+}
+
+// Add adds v to the gauge, v may be negative
+func (g *Gauge) Add(v float64) {
+	if g == nil {
+		return
+	}
+	g.m.mutex.Lock()
+	g.s.value += v
+	g.m.mutex.Unlock()
+}
+
+// GaugeFunc registers a gauge whose value is returned by fn when the
+// metrics are collected
+func (m *Metrics) GaugeFunc(name, help string, fn func() float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	s := m.series(name, help, "gauge", nil, labels)
+	m.mutex.Lock()
+	s.fn = fn
+	m.mutex.Unlock()
+}
+
+// CounterFunc registers a counter whose value is returned by fn when the
+// metrics are collected
+func (m *Metrics) CounterFunc(name, help string, fn func() float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	s := m.series(name, help, "counter", nil, labels)
+	m.mutex.Lock()
+	s.fn = fn
+	m.mutex.Unlock()
+}
+
+// Histogram counts observations in buckets
+type Histogram struct {
+	m *Metrics
+	f *metricFamily
+	s *metricSeries
+}
+
+// Histogram returns the histogram name with the labels, given as name and
+// value pairs. It is created on first use with the buckets upper bounds,
+// the buckets of the first use are kept for all the labels.
+func (m *Metrics) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if m == nil {
+		return nil
+	}
+	s := m.series(name, help, "histogram", buckets, labels)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return &Histogram{m: m, f: m.families[name], s: s}
+}
+
+// Observe adds an observation to the histogram
+func (h *Histogram) Observe(v float64) {
+	if h == nil {
+		return
+	}
+	h.m.mutex.Lock()
+	defer h.m.mutex.Unlock()
+	for i, bound := range h.f.buckets {
+		if v <= bound {
+			h.s.counts[i]++
+		}
+	}
+	h.s.count++
+	h.s.value += v
+}
+
+// series returns the series of the family name with the labels, the family
+// and the series are created on first use
+func (m *Metrics) series(name, help, kind string, buckets []float64, labels []string) *metricSeries {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	f, ok := m.families[name]
+	if !ok {
+		f = &metricFamily{name: name, help: help, kind: kind, buckets: buckets, series: make(map[string]*metricSeries)}
+		m.families[name] = f
+	}
+	key := formatLabels(labels)
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{labels: key, counts: make([]uint64, len(f.buckets))}
+		f.series[key] = s
+	}
+	return s
+}
+
+// formatLabels renders name and value pairs as {name="value",...}
+func formatLabels(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(labels[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// withLabel adds a label to rendered labels
+func withLabel(labels, name, value string) string {
+	label := name + `="` + escapeLabelValue(value) + `"`
+	if labels == "" {
+		return "{" + label + "}"
+	}
+	return labels[:len(labels)-1] + "," + label + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// WriteTo writes the metrics in the Prometheus text format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	if m == nil {
+		return 0, nil
+	}
+	// the functions are called without the lock, they may use the metrics
+	m.mutex.Lock()
+	var funcs []*metricSeries
+	for _, f := range m.families {
+		for _, s := range f.series {
+			if s.fn != nil {
+				funcs = append(funcs, s)
+			}
+		}
+	}
+	m.mutex.Unlock()
+	values := make(map[*metricSeries]float64, len(funcs))
+	for _, s := range funcs {
+		values[s] = s.fn()
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	cw := &countingWriter{w: bw}
+	for _, name := range names {
+		f := m.families[name]
+		fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := f.series[key]
+			if f.kind != "histogram" {
+				value := s.value
+				if s.fn != nil {
+					value = values[s]
+				}
+				fmt.Fprintf(cw, "%s%s %s\n", f.name, s.labels, formatFloat(value))
+				continue
+			}
+			for i, bound := range f.buckets {
+				fmt.Fprintf(cw, "%s_bucket%s %d\n", f.name, withLabel(s.labels, "le", formatFloat(bound)), s.counts[i])
+			}
+			fmt.Fprintf(cw, "%s_bucket%s %d\n", f.name, withLabel(s.labels, "le", "+Inf"), s.count)
+			fmt.Fprintf(cw, "%s_sum%s %s\n", f.name, s.labels, formatFloat(s.value))
+			fmt.Fprintf(cw, "%s_count%s %d\n", f.name, s.labels, s.count)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return cw.n, err
+	}
+	return cw.n, cw.err
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// ListenAndServeMetrics serves the metrics of the server over HTTP on
+// addr, at the /metrics path
+func (s *Server) ListenAndServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.Metrics)
+	s.log.Debug("Listening metrics", log.Ctx{"addr": addr})
+	return http.ListenAndServe(addr, mux)
+}
+
+// registerMetrics registers the metrics of the server activity
+func (s *Server) registerMetrics() {
+	m := s.Metrics
+	m.GaugeFunc("ldap_connections_open", "Number of open client connections.", func() float64 {
+		return float64(s.Stats().Connections)
+	})
+	m.CounterFunc("ldap_connections_total", "Number of accepted client connections.", func() float64 {
+		return float64(s.Stats().Accepted)
+	})
+	m.GaugeFunc("ldap_operations_in_progress", "Number of operations in progress.", func() float64 {
+		return float64(s.Stats().Requests)
+	})
+	m.CounterFunc("ldap_busy_responses_total", "Number of requests answered with busy.", func() float64 {
+		return float64(s.Stats().BusyResponses)
+	})
+	s.bytesReceived = m.Counter("ldap_received_bytes_total", "Number of bytes of the LDAP messages received.")
+	s.bytesSent = m.Counter("ldap_sent_bytes_total", "Number of bytes of the LDAP messages sent.")
+}
+
+// observeOperation records a processed request, the route is the label of
+// the route which handled it and code its final result code, nil when no
+// final response was sent
+func (s *Server) observeOperation(m *Message, code *int, duration time.Duration) {
+	operation := m.ProtocolOpName()
+	result := "none"
+	if code != nil {
+		result = strconv.Itoa(*code)
+	}
+	s.Metrics.Counter("ldap_operations_total", "Number of operations processed.",
+		"operation", operation, "route", m.route, "result", result).Inc()
+	s.Metrics.Histogram("ldap_operation_duration_seconds", "Duration of the operations.", DefaultDurationBuckets,
+		"operation", operation).Observe(duration.Seconds())
+}
@@ -0,0 +1,84 @@
+package ldap
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// ServeLDAP calls f(w, r)
+func (f HandlerFunc) ServeLDAP(w ResponseWriter, r *Message) {
+	f(w, r)
+}
+
+// Middleware wraps a Handler with cross-cutting logic, ie authorization
+// checks, auditing or rate limiting. The middleware gets the request and
+// its session through the *Message, it may answer the request itself
+// instead of calling the next handler. Once the next handler returns, the
+// result code it sent is given by Message.Result.
+type Middleware func(next Handler) Handler
+
+// chain wraps h with the middlewares, the first one is the outermost
+func chain(middlewares []Middleware, h Handler) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// Logging returns a middleware logging each request with its result code
+// and duration at the debug level
+func Logging(logger log.Logger) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Message) {
+			start := time.Now()
+			next.ServeLDAP(w, r)
+			ctx := log.Ctx{"clientid": r.Client.ID(), "messageid": r.MessageID().Int(), "operation": r.ProtocolOpName(), "duration": time.Since(start)}
+			if code, ok := r.Result(); ok {
+				ctx["result"] = code
+			}
+			logger.Debug("request served", ctx)
+		})
+	}
+}
+
+// Recovery returns a middleware recovering from a panic of the next
+// handlers. The panic is logged with its stack trace and the request is
+// answered with the other result code when no final response was sent
+// yet, the connection and the server keep running.
+func Recovery(logger log.Logger) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Message) {
+			defer func() {
+				e := recover()
+				if e == nil {
+					return
+				}
+				logger.Error("panic serving request", log.Ctx{"clientid": r.Client.ID(), "messageid": r.MessageID().Int(), "operation": r.ProtocolOpName(), "panic": fmt.Sprint(e), "stack": string(debug.Stack())})
+				if r.hasResponded() {
+					return
+				}
+				if res := NewResponseForRequest(r, LDAPResultOther, "internal server error"); res != nil {
+					w.Write(res)
+				}
+			}()
+			next.ServeLDAP(w, r)
+		})
+	}
+}
+
+// Timing returns a middleware logging at the info level the requests
+// taking longer than threshold to be served
+func Timing(logger log.Logger, threshold time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Message) {
+			start := time.Now()
+			next.ServeLDAP(w, r)
+			if duration := time.Since(start); duration > threshold {
+				logger.Info("slow request", log.Ctx{"clientid": r.Client.ID(), "messageid": r.MessageID().Int(), "operation": r.ProtocolOpName(), "duration": duration})
+			}
+		})
+	}
+}
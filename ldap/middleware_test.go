@@ -0,0 +1,289 @@
+package ldap
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// middlewareTestBackend answers the searches by base object: cn=panic
+// panics, cn=respond-panic panics once answered, cn=busy is answered with
+// busy and cn=slow after a while. The other operations are not
+// implemented.
+type middlewareTestBackend struct{}
+
+func (b middlewareTestBackend) Start() error { return nil }
+
+func (b middlewareTestBackend) Search(w ResponseWriter, m *Message) {
+	r := m.GetSearchRequest()
+	switch string(r.BaseObject()) {
+	case "cn=panic":
+		panic("search failed")
+	case "cn=respond-panic":
+		w.Write(NewSearchResultDoneResponse(LDAPResultSuccess))
+		panic("search failed")
+	case "cn=busy":
+		w.Write(NewSearchResultDoneResponse(LDAPResultBusy))
+	case "cn=slow":
+		time.Sleep(100 * time.Millisecond)
+		w.Write(NewSearchResultDoneResponse(LDAPResultSuccess))
+	default:
+		w.Write(NewSearchResultDoneResponse(LDAPResultSuccess))
+	}
+}
+
+func (b middlewareTestBackend) notImplemented(w ResponseWriter, m *Message) {
+	if res := NewResponseForRequest(m, LDAPResultUnwillingToPerform, "not implemented"); res != nil {
+		w.Write(res)
+	}
+}
+
+func (b middlewareTestBackend) NotFound(w ResponseWriter, m *Message) { b.notImplemented(w, m) }
+func (b middlewareTestBackend) Bind(w ResponseWriter, m *Message)     { b.notImplemented(w, m) }
+func (b middlewareTestBackend) Add(w ResponseWriter, m *Message)      { b.notImplemented(w, m) }
+func (b middlewareTestBackend) Delete(w ResponseWriter, m *Message)   { b.notImplemented(w, m) }
+func (b middlewareTestBackend) Modify(w ResponseWriter, m *Message)   { b.notImplemented(w, m) }
+func (b middlewareTestBackend) ModifyDN(w ResponseWriter, m *Message) { b.notImplemented(w, m) }
+func (b middlewareTestBackend) Extended(w ResponseWriter, m *Message) { b.notImplemented(w, m) }
+func (b middlewareTestBackend) Compare(w ResponseWriter, m *Message)  { b.notImplemented(w, m) }
+func (b middlewareTestBackend) Abandon(w ResponseWriter, m *Message)  {}
+
+// newMiddlewareTestServer returns a server routing its requests with a new
+// RouteMux, given to setup before serving
+func newMiddlewareTestServer(t *testing.T, setup func(mux *RouteMux)) string {
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	mux := NewRouteMux(logger)
+	setup(mux)
+	return serveTCP(t, newTestServer(mux.ServeLDAP))
+}
+
+// testLogger records the logs of the middlewares
+type testLogger struct {
+	log.Logger
+	records chan *log.Record
+}
+
+func newTestLogger() *testLogger {
+	l := &testLogger{Logger: log.New(), records: make(chan *log.Record, 64)}
+	l.SetHandler(log.FuncHandler(func(r *log.Record) error {
+		l.records <- r
+		return nil
+	}))
+	return l
+}
+
+// next returns the next record, with its context by key
+func (l *testLogger) next(t *testing.T) (*log.Record, map[string]interface{}) {
+	t.Helper()
+	select {
+	case r := <-l.records:
+		ctx := make(map[string]interface{})
+		for i := 0; i+1 < len(r.Ctx); i += 2 {
+			ctx[r.Ctx[i].(string)] = r.Ctx[i+1]
+		}
+		return r, ctx
+	case <-time.After(5 * time.Second):
+		t.Fatal("no log record")
+		return nil, nil
+	}
+}
+
+// empty checks that nothing more was logged
+func (l *testLogger) empty(t *testing.T) {
+	t.Helper()
+	select {
+	case r := <-l.records:
+		t.Errorf("unexpected log record %q", r.Msg)
+	default:
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	logger := newTestLogger()
+	addr := newMiddlewareTestServer(t, func(mux *RouteMux) {
+		mux.Use(Recovery(logger))
+		mux.Search(middlewareTestBackend{})
+	})
+	c := dialTest(t, "tcp", addr)
+
+	// the panicking request gets the other result code
+	c.search(1, "cn=panic")
+	if id, code := c.readResult(); id != 1 || code != LDAPResultOther {
+		t.Errorf("got message %d with result %d, want message 1 with other", id, code)
+	}
+	r, ctx := logger.next(t)
+	if r.Msg != "panic serving request" || r.Lvl != log.LvlError || ctx["panic"] != "search failed" || !strings.Contains(ctx["stack"].(string), "middlewareTestBackend.Search") {
+		t.Errorf("got record %q %v, want the panic and its stack", r.Msg, ctx)
+	}
+
+	// the connection stays usable
+	c.search(2, "dc=org")
+	if id, code := c.readResult(); id != 2 || code != LDAPResultSuccess {
+		t.Errorf("got message %d with result %d, want message 2 with success", id, code)
+	}
+
+	// a request already answered does not get a second response
+	c.search(3, "cn=respond-panic")
+	if id, code := c.readResult(); id != 3 || code != LDAPResultSuccess {
+		t.Errorf("got message %d with result %d, want message 3 with success", id, code)
+	}
+	logger.next(t)
+	c.search(4, "dc=org")
+	if id, code := c.readResult(); id != 4 || code != LDAPResultSuccess {
+		t.Errorf("got message %d with result %d, want message 4 with success", id, code)
+	}
+	logger.empty(t)
+}
+
+func TestMiddlewareResult(t *testing.T) {
+	type result struct {
+		code int
+		ok   bool
+	}
+	results := make(chan result, 1)
+	addr := newMiddlewareTestServer(t, func(mux *RouteMux) {
+		mux.Use(func(next Handler) Handler {
+			return HandlerFunc(func(w ResponseWriter, r *Message) {
+				if _, ok := r.Result(); ok {
+					t.Error("result set before the request is served")
+				}
+				next.ServeLDAP(w, r)
+				code, ok := r.Result()
+				results <- result{code, ok}
+			})
+		})
+		mux.Search(middlewareTestBackend{})
+		// a middleware may answer the request itself
+		mux.Search(middlewareTestBackend{}).BaseDn("dc=denied").Use(func(next Handler) Handler {
+			return HandlerFunc(func(w ResponseWriter, r *Message) {
+				w.Write(NewSearchResultDoneResponse(LDAPResultInsufficientAccessRights))
+			})
+		})
+		mux.Search(middlewareTestBackend{}).BaseDn("dc=silent").Use(func(next Handler) Handler {
+			return HandlerFunc(func(w ResponseWriter, r *Message) {})
+		})
+	})
+	c := dialTest(t, "tcp", addr)
+
+	tests := []struct {
+		base string
+		want result
+	}{
+		{"dc=org", result{LDAPResultSuccess, true}},
+		{"cn=busy", result{LDAPResultBusy, true}},
+		{"dc=denied", result{LDAPResultInsufficientAccessRights, true}},
+		{"dc=silent", result{0, false}},
+	}
+	for i, tt := range tests {
+		c.search(i+1, tt.base)
+		if tt.want.ok {
+			if _, code := c.readResult(); code != tt.want.code {
+				t.Errorf("%s: got result %d, want %d", tt.base, code, tt.want.code)
+			}
+		}
+		if got := <-results; got != tt.want {
+			t.Errorf("%s: outer middleware got %v, want %v", tt.base, got, tt.want)
+		}
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	var mutex sync.Mutex
+	var calls []string
+	record := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(w ResponseWriter, r *Message) {
+				mutex.Lock()
+				calls = append(calls, name)
+				mutex.Unlock()
+				next.ServeLDAP(w, r)
+				mutex.Lock()
+				calls = append(calls, "/"+name)
+				mutex.Unlock()
+			})
+		}
+	}
+	addr := newMiddlewareTestServer(t, func(mux *RouteMux) {
+		mux.Use(record("global1"), record("global2"))
+		mux.Search(middlewareTestBackend{}).BaseDn("dc=org").Use(record("route1")).Use(record("route2"))
+		mux.NotFound(middlewareTestBackend{})
+		// added after the routes, it still wraps them
+		mux.Use(record("global3"))
+	})
+	c := dialTest(t, "tcp", addr)
+
+	tests := []struct {
+		base string
+		code int
+		want string
+	}{
+		{"dc=org", LDAPResultSuccess, "global1 global2 global3 route1 route2 /route2 /route1 /global3 /global2 /global1"},
+		// the requests no route matches only go through the global ones,
+		// the not found route has none
+		{"dc=com", LDAPResultUnwillingToPerform, "global1 global2 global3 /global3 /global2 /global1"},
+	}
+	for i, tt := range tests {
+		mutex.Lock()
+		calls = nil
+		mutex.Unlock()
+		c.search(i+1, tt.base)
+		if _, code := c.readResult(); code != tt.code {
+			t.Errorf("%s: got result %d, want %d", tt.base, code, tt.code)
+		}
+		// the middlewares return once the response is sent
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+			mutex.Lock()
+			got := strings.Join(calls, " ")
+			mutex.Unlock()
+			if got == tt.want {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Errorf("%s: got calls %q, want %q", tt.base, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestLoggingAndTiming(t *testing.T) {
+	logger := newTestLogger()
+	addr := newMiddlewareTestServer(t, func(mux *RouteMux) {
+		mux.Use(Logging(logger), Timing(logger, 50*time.Millisecond))
+		mux.Search(middlewareTestBackend{})
+	})
+	c := dialTest(t, "tcp", addr)
+
+	// a fast request is only logged at the debug level
+	c.search(1, "cn=busy")
+	c.readResult()
+	r, ctx := logger.next(t)
+	if r.Msg != "request served" || r.Lvl != log.LvlDebug {
+		t.Fatalf("got record %q at %s, want request served at debug", r.Msg, r.Lvl)
+	}
+	if ctx["messageid"] != 1 || ctx["operation"] != "SearchRequest" || ctx["result"] != LDAPResultBusy {
+		t.Errorf("got context %v, want the message 1 SearchRequest with busy", ctx)
+	}
+	if _, ok := ctx["duration"].(time.Duration); !ok {
+		t.Errorf("got duration %v, want a time.Duration", ctx["duration"])
+	}
+
+	// a slow one is reported by Timing
+	c.search(2, "cn=slow")
+	c.readResult()
+	r, ctx = logger.next(t)
+	if r.Msg != "slow request" || r.Lvl != log.LvlInfo {
+		t.Fatalf("got record %q at %s, want slow request at info", r.Msg, r.Lvl)
+	}
+	if d, _ := ctx["duration"].(time.Duration); ctx["messageid"] != 2 || d < 50*time.Millisecond {
+		t.Errorf("got context %v, want the message 2 lasting over 50ms", ctx)
+	}
+	if r, _ = logger.next(t); r.Msg != "request served" {
+		t.Errorf("got record %q, want request served", r.Msg)
+	}
+	logger.empty(t)
+}
@@ -0,0 +1,52 @@
+package ldap
+
+import (
+	"fmt"
+
+	"github.com/jsimonetti/ldapserv/internal/ber"
+	ldap "github.com/lor00x/goldap/message"
+)
+
+// ModifyDNRequest holds the fields of a ModifyDN request, NewSuperior is
+// nil when the entry keeps its parent
+// @see RFC https://tools.ietf.org/html/rfc4511#section-4.9
+type ModifyDNRequest struct {
+	Entry        string
+	NewRDN       string
+	DeleteOldRDN bool
+	NewSuperior  *string
+}
+
+// ParseModifyDNRequest returns the fields of the ModifyDN request of m
+//
+//	ModifyDNRequest ::= [APPLICATION 12] SEQUENCE {
+//	        entry           LDAPDN,
+//	        newrdn          RelativeLDAPDN,
+//	        deleteoldrdn    BOOLEAN,
+//	        newSuperior     [0] LDAPDN OPTIONAL }
+func ParseModifyDNRequest(m *Message) (ModifyDNRequest, error) {
+	var r ModifyDNRequest
+	op, err := encodeProtocolOp(m.GetModifyDNRequest())
+	if err != nil {
+		return r, err
+	}
+	elements, err := ber.DecodeAll(op.Content)
+	if err != nil {
+		return r, err
+	}
+	if len(elements) < 3 || len(elements) > 4 ||
+		elements[0].Tag != ber.TagOctetString || elements[1].Tag != ber.TagOctetString || elements[2].Tag != ber.TagBoolean {
+		return r, fmt.Errorf("invalid ModifyDN request")
+	}
+	r.Entry = string(elements[0].Content)
+	r.NewRDN = string(elements[1].Content)
+	r.DeleteOldRDN = elements[2].Bool()
+	if len(elements) == 4 {
+		if elements[3].Tag != ber.ClassContext|ldap.TagModifyDNRequestNewSuperior {
+			return r, fmt.Errorf("invalid ModifyDN request new superior")
+		}
+		superior := string(elements[3].Content)
+		r.NewSuperior = &superior
+	}
+	return r, nil
+}
@@ -4,7 +4,9 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"io"
 
+	"github.com/jsimonetti/ldapserv/internal/ber"
 	ldap "github.com/lor00x/goldap/message"
 )
 
@@ -12,29 +14,59 @@ type messagePacket struct {
 	bytes []byte
 }
 
-func readMessagePacket(br *bufio.Reader) (*messagePacket, error) {
-	var err error
-	var bytes *[]byte
-	bytes, err = readLdapMessageBytes(br)
-
-	if err == nil {
-		messagePacket := &messagePacket{bytes: *bytes}
-		return messagePacket, err
+// readMessagePacket reads a whole LDAP message from the client, messages
+// larger than maxSize() bytes are refused. The limit is asked once the
+// message starts arriving since it may change meanwhile, ie when a bind
+// completes. The errors about the framing of the message are
+// ldap.SyntaxError or ldap.StructuralError, the other errors come from the
+// connection.
+func readMessagePacket(br *bufio.Reader, maxSize func() int) (*messagePacket, error) {
+	bytes, err := readLdapMessageBytes(br, maxSize)
+	if err != nil {
+		return nil, err
 	}
-	return &messagePacket{}, err
-
+	return &messagePacket{bytes: bytes}, nil
 }
 
+// readMessage decodes the message, the errors never hold the bytes of the
+// packet since they may be credentials
 func (msg *messagePacket) readMessage() (m ldap.LDAPMessage, err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			err = fmt.Errorf("invalid packet received hex=%x, %#v", msg.bytes, r)
+			err = fmt.Errorf("invalid packet received: %v", r)
 		}
 	}()
 
 	return decodeMessage(msg.bytes)
 }
 
+// opName returns the name of the protocol op of the packet, from its tag
+// alone so that it is known when the message can not be decoded
+func (msg *messagePacket) opName() string {
+	elements, err := ber.DecodeSequence(msg.bytes)
+	if err != nil || len(elements) < 2 {
+		return "unknown"
+	}
+	if name, ok := protocolOpNames[elements[1].Tag&0x1f]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// protocolOpNames are the names of the requests by application tag
+var protocolOpNames = map[byte]string{
+	ldap.TagBindRequest:     BIND,
+	ldap.TagUnbindRequest:   "UnbindRequest",
+	ldap.TagSearchRequest:   SEARCH,
+	ldap.TagModifyRequest:   MODIFY,
+	ldap.TagAddRequest:      ADD,
+	ldap.TagDelRequest:      DELETE,
+	ldap.TagModifyDNRequest: MODIFYDN,
+	ldap.TagCompareRequest:  COMPARE,
+	ldap.TagAbandonRequest:  ABANDON,
+	ldap.TagExtendedRequest: EXTENDED,
+}
+
 func decodeMessage(bytes []byte) (ret ldap.LDAPMessage, err error) {
 	defer func() {
 		if e := recover(); e != nil {
@@ -42,21 +74,75 @@ func decodeMessage(bytes []byte) (ret ldap.LDAPMessage, err error) {
 		}
 	}()
 	zero := 0
-	ret, err = ldap.ReadLDAPMessage(ldap.NewBytes(zero, bytes))
+	ret, err = ldap.ReadLDAPMessage(ldap.NewBytes(zero, addDefaultDnAttributes(bytes)))
 	return
 }
 
+// addDefaultDnAttributes encodes the dnAttributes of the extensible match
+// filters of a search request which leave it to its default value, goldap
+// fails to read them otherwise. The other messages are returned unchanged.
+func addDefaultDnAttributes(packet []byte) []byte {
+	elements, err := ber.DecodeSequence(packet)
+	if err != nil || len(elements) < 2 || elements[1].Tag != ber.ClassApplication|ber.Constructed|ldap.TagSearchRequest {
+		return packet
+	}
+	search, err := ber.DecodeAll(elements[1].Content)
+	if err != nil || len(search) < 7 {
+		return packet
+	}
+	if search[6], err = withDnAttributes(search[6]); err != nil {
+		return packet
+	}
+	elements[1].Content = ber.EncodeElements(search)
+	return ber.Encode(ber.TagSequence, ber.EncodeElements(elements))
+}
+
+// withDnAttributes returns the filter with the dnAttributes of its
+// extensible match filters encoded
+func withDnAttributes(filter ber.Element) (ber.Element, error) {
+	switch filter.Tag {
+	case ber.ClassContext | ber.Constructed | ldap.TagFilterAnd,
+		ber.ClassContext | ber.Constructed | ldap.TagFilterOr,
+		ber.ClassContext | ber.Constructed | ldap.TagFilterNot:
+		children, err := ber.DecodeAll(filter.Content)
+		if err != nil {
+			return filter, err
+		}
+		for i := range children {
+			if children[i], err = withDnAttributes(children[i]); err != nil {
+				return filter, err
+			}
+		}
+		filter.Content = ber.EncodeElements(children)
+	case ber.ClassContext | ber.Constructed | ldap.TagFilterExtensibleMatch:
+		fields, err := ber.DecodeAll(filter.Content)
+		if err != nil {
+			return filter, err
+		}
+		if len(fields) > 0 && fields[len(fields)-1].Tag != ber.ClassContext|ldap.TagMatchingRuleAssertionDnAttributes {
+			filter.Content = append(ber.EncodeElements(fields), ber.Encode(ber.ClassContext|ldap.TagMatchingRuleAssertionDnAttributes, []byte{0x00})...)
+		}
+	}
+	return filter, nil
+}
+
 // BELLOW SHOULD BE IN ROOX PACKAGE
 
-func readLdapMessageBytes(br *bufio.Reader) (ret *[]byte, err error) {
+func readLdapMessageBytes(br *bufio.Reader, maxSize func() int) ([]byte, error) {
 	var bytes []byte
-	var tagAndLength ldap.TagAndLength
-	tagAndLength, err = readTagAndLength(br, &bytes)
+	tagAndLength, err := readTagAndLength(br, &bytes)
 	if err != nil {
-		return
+		return nil, err
+	}
+	// the length is checked before reading, a client announcing a huge
+	// message does not make us allocate it
+	if max := maxSize(); max > 0 && tagAndLength.Length > max {
+		return nil, ldap.StructuralError{Msg: fmt.Sprintf("message of %d bytes exceeds the limit of %d bytes", tagAndLength.Length, max)}
+	}
+	if _, err = readBytes(br, &bytes, tagAndLength.Length); err != nil {
+		return nil, err
 	}
-	readBytes(br, &bytes, tagAndLength.Length)
-	return &bytes, err
+	return bytes, nil
 }
 
 // readTagAndLength parses an ASN.1 tag and length pair from a live connection
@@ -86,7 +172,8 @@ func readTagAndLength(conn *bufio.Reader, bytes *[]byte) (ret ldap.TagAndLength,
 	//	}
 	// We are expecting the LDAP sequence tag 0x30 as first byte
 	if b != 0x30 {
-		panic(fmt.Sprintf("Expecting 0x30 as first byte, but got %#x instead", b))
+		err = ldap.SyntaxError{Msg: fmt.Sprintf("expecting 0x30 as first byte, but got %#x instead", b)}
+		return
 	}
 
 	b, err = readBytes(conn, bytes, 1)
@@ -100,7 +187,7 @@ func readTagAndLength(conn *bufio.Reader, bytes *[]byte) (ret ldap.TagAndLength,
 		// Bottom 7 bits give the number of length bytes to follow.
 		numBytes := int(b & 0x7f)
 		if numBytes == 0 {
-			err = ldap.SyntaxError{"indefinite length found (not DER)"}
+			err = ldap.SyntaxError{Msg: "indefinite length found (not DER)"}
 			return
 		}
 		ret.Length = 0
@@ -113,14 +200,14 @@ func readTagAndLength(conn *bufio.Reader, bytes *[]byte) (ret ldap.TagAndLength,
 			if ret.Length >= 1<<23 {
 				// We can't shift ret.length up without
 				// overflowing.
-				err = ldap.StructuralError{"length too large"}
+				err = ldap.StructuralError{Msg: "length too large"}
 				return
 			}
 			ret.Length <<= 8
 			ret.Length |= int(b)
 			if ret.Length == 0 {
 				// DER requires that lengths be minimal.
-				err = ldap.StructuralError{"superfluous leading zeros in length"}
+				err = ldap.StructuralError{Msg: "superfluous leading zeros in length"}
 				return
 			}
 		}
@@ -129,15 +216,15 @@ func readTagAndLength(conn *bufio.Reader, bytes *[]byte) (ret ldap.TagAndLength,
 	return
 }
 
-// Read "length" bytes from the connection
+// Read "length" bytes from the connection, waiting for all of them
 // Append the read bytes to "bytes"
 // Return the last read byte
 func readBytes(conn *bufio.Reader, bytes *[]byte, length int) (b byte, err error) {
+	if length == 0 {
+		return
+	}
 	newbytes := make([]byte, length)
-	n, err := conn.Read(newbytes)
-	if n != length {
-		fmt.Errorf("%d bytes read instead of %d", n, length)
-	} else if err != nil {
+	if _, err = io.ReadFull(conn, newbytes); err != nil {
 		return
 	}
 	*bytes = append(*bytes, newbytes...)
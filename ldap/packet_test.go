@@ -0,0 +1,162 @@
+package ldap
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jsimonetti/ldapserv/internal/ber"
+	ldap "github.com/lor00x/goldap/message"
+)
+
+// newPacketTestServer returns a server accepting every simple bind and
+// search
+func newPacketTestServer() *Server {
+	return newTestServer(func(w ResponseWriter, m *Message) {
+		switch m.ProtocolOp().(type) {
+		case ldap.BindRequest:
+			w.Write(NewBindResponse(LDAPResultSuccess))
+		default:
+			w.Write(NewSearchResultDoneResponse(LDAPResultSuccess))
+		}
+	})
+}
+
+// bind sends a simple bind as name
+func (c *testConn) bind(messageID int, name, password string) {
+	op := ber.Encode(ber.ClassApplication|ber.Constructed|ldap.TagBindRequest,
+		ber.Integer(3),
+		ber.OctetString([]byte(name)),
+		ber.Encode(ber.ClassContext|ldap.TagAuthenticationChoiceSimple, []byte(password)),
+	)
+	if _, err := c.conn.Write(ber.Sequence(ber.Integer(int64(messageID)), op)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func TestReadMessagePacketSplit(t *testing.T) {
+	s := newPacketTestServer()
+	addr := serveTCP(t, s)
+	c := dialTest(t, "tcp", addr)
+
+	search := func(messageID int) []byte {
+		op := ber.Encode(ber.ClassApplication|ber.Constructed|ldap.TagSearchRequest,
+			ber.OctetString([]byte("dc="+strings.Repeat("x", 200))),
+			ber.Enumerated(SearchRequestScopeBaseObject),
+			ber.Enumerated(0),
+			ber.Integer(0),
+			ber.Integer(0),
+			ber.Boolean(false),
+			ber.Encode(ber.ClassContext|ldap.TagFilterPresent, []byte("objectClass")),
+			ber.Sequence(),
+		)
+		return ber.Sequence(ber.Integer(int64(messageID)), op)
+	}
+
+	// a message sent a few bytes at a time, its length taking two bytes
+	packet := search(1)
+	for i := 0; i < len(packet); i += 3 {
+		end := i + 3
+		if end > len(packet) {
+			end = len(packet)
+		}
+		if _, err := c.conn.Write(packet[i:end]); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if id, code := c.readResult(); id != 1 || code != LDAPResultSuccess {
+		t.Fatalf("got message %d with result %d, want message 1 with success", id, code)
+	}
+
+	// two messages in a single write, the second one cut in the middle
+	packet = append(search(2), search(3)...)
+	half := len(packet) - len(search(3))/2
+	c.conn.Write(packet[:half])
+	time.Sleep(10 * time.Millisecond)
+	c.conn.Write(packet[half:])
+	for _, want := range []int{2, 3} {
+		if id, code := c.readResult(); id != want || code != LDAPResultSuccess {
+			t.Errorf("got message %d with result %d, want message %d with success", id, code, want)
+		}
+	}
+}
+
+func TestReadMessagePacketErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+	}{
+		{"bad first byte", []byte{0x31, 0x03, 0x02, 0x01, 0x01}},
+		{"garbage", []byte("GET / HTTP/1.0\r\n\r\n")},
+		{"indefinite length", []byte{0x30, 0x80, 0x02, 0x01, 0x01, 0x00, 0x00}},
+		{"non-minimal length", []byte{0x30, 0x82, 0x00, 0x03, 0x02, 0x01, 0x01}},
+		{"length too large", []byte{0x30, 0x84, 0x7f, 0xff, 0xff, 0xff}},
+		{"above the anonymous limit", []byte{0x30, 0x83, 0x04, 0x00, 0x01}},
+		{"missing protocol op", []byte{0x30, 0x03, 0x02, 0x01, 0x01}},
+		{"unknown protocol op", []byte{0x30, 0x05, 0x02, 0x01, 0x01, 0x7e, 0x00}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newPacketTestServer()
+			addr := serveTCP(t, s)
+			c := dialTest(t, "tcp", addr)
+			if _, err := c.conn.Write(tt.packet); err != nil {
+				t.Fatal(err)
+			}
+			if code := c.readNotice(); code != LDAPResultProtocolError {
+				t.Errorf("got result %d, want protocolError", code)
+			}
+			c.expectClosed()
+		})
+	}
+}
+
+func TestReadMessagePacketTruncated(t *testing.T) {
+	s := newPacketTestServer()
+	addr := serveTCP(t, s)
+	c := dialTest(t, "tcp", addr)
+
+	// the connection ends in the middle of a message, there is no one left
+	// to notify
+	c.conn.Write([]byte{0x30, 0x05, 0x02, 0x01})
+	c.conn.(*net.TCPConn).CloseWrite()
+	c.expectClosed()
+}
+
+func TestMaxPDUSize(t *testing.T) {
+	s := newPacketTestServer()
+	s.MaxPDUSizeAnonymous = 300
+	s.MaxPDUSize = 1000
+	addr := serveTCP(t, s)
+	base := "dc=" + strings.Repeat("x", 500)
+
+	// an anonymous client is held to the lower limit
+	anonymous := dialTest(t, "tcp", addr)
+	anonymous.search(1, "dc=small")
+	if _, code := anonymous.readResult(); code != LDAPResultSuccess {
+		t.Fatalf("got result %d, want success", code)
+	}
+	anonymous.search(2, base)
+	if code := anonymous.readNotice(); code != LDAPResultProtocolError {
+		t.Errorf("got result %d, want protocolError", code)
+	}
+	anonymous.expectClosed()
+
+	// a bound one to the higher limit
+	bound := dialTest(t, "tcp", addr)
+	bound.bind(1, "cn=admin,dc=org", "secret")
+	if _, code := bound.readResult(); code != LDAPResultSuccess {
+		t.Fatalf("bind got result %d, want success", code)
+	}
+	bound.search(2, base)
+	if _, code := bound.readResult(); code != LDAPResultSuccess {
+		t.Fatalf("got result %d, want success", code)
+	}
+	bound.search(3, base+strings.Repeat("x", 500))
+	if code := bound.readNotice(); code != LDAPResultProtocolError {
+		t.Errorf("got result %d, want protocolError", code)
+	}
+	bound.expectClosed()
+}
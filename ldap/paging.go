@@ -0,0 +1,185 @@
+package ldap
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/jsimonetti/ldapserv/internal/ber"
+	ldap "github.com/lor00x/goldap/message"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// ControlTypePaging is the Simple Paged Results control
+// @see RFC https://tools.ietf.org/html/rfc2696
+const ControlTypePaging = "1.2.840.113556.1.4.319"
+
+// maxPagedSearches is the number of paged searches a client can keep
+// open at the same time, the oldest one is dropped when exceeded
+const maxPagedSearches = 10
+
+// PagingControl is the value of a Simple Paged Results control
+type PagingControl struct {
+	Size   int
+	Cookie []byte
+}
+
+// ParsePagingControl decodes the value of a paged results control
+//
+//	realSearchControlValue ::= SEQUENCE {
+//	        size            INTEGER (0..maxInt),
+//	                                -- requested page size from client
+//	                                -- result set size estimate from server
+//	        cookie          OCTET STRING
+//	}
+func ParsePagingControl(c Control) (PagingControl, error) {
+	var p PagingControl
+	elements, err := ber.DecodeSequence(c.Value)
+	if err != nil {
+		return p, err
+	}
+	if len(elements) != 2 || elements[0].Tag != ber.TagInteger || elements[1].Tag != ber.TagOctetString {
+		return p, fmt.Errorf("invalid paged results control value")
+	}
+	size, err := elements[0].Int()
+	if err != nil {
+		return p, err
+	}
+	if size < 0 || size > 1<<31-1 {
+		return p, fmt.Errorf("invalid paged results size %d", size)
+	}
+	p.Size = int(size)
+	p.Cookie = elements[1].Content
+	return p, nil
+}
+
+// Control returns the paged results control to send to the client
+func (p PagingControl) Control() Control {
+	value := ber.Sequence(ber.Integer(int64(p.Size)), ber.OctetString(p.Cookie))
+	return NewControl(ControlTypePaging, false, value)
+}
+
+// pagedSearch is the state of a paged search kept on the client
+// connection between two pages
+type pagedSearch struct {
+	cookie    string
+	search    string
+	messageID int
+	entries   []ldap.SearchResultEntry
+	total     int
+	// result is the result code of the last page, sizeLimitExceeded
+	// when the search returned less entries than found
+	result int
+}
+
+// WritePagedResults writes the page of entries requested by the paged
+// results control of m and attaches the response control. The search
+// function is only called for the first page, the remaining entries are
+// kept on the connection until they are requested, the search is abandoned
+// or the client disconnects.
+// It returns the result code to send in the SearchResultDone, the
+// sizeLimitExceeded code of the search is returned with the last page.
+func WritePagedResults(w ResponseWriter, m *Message, search func() ([]ldap.SearchResultEntry, int)) int {
+	c, _ := m.GetControl(ControlTypePaging)
+	paging, err := ParsePagingControl(c)
+	if err != nil {
+		m.Client.client.log.Debug("invalid paged results control", log.Ctx{"error": err})
+		return LDAPResultProtocolError
+	}
+
+	key := pagedSearchKey(m.GetSearchRequest())
+	var ps *pagedSearch
+	if len(paging.Cookie) == 0 {
+		entries, code := search()
+		if code != LDAPResultSuccess && code != LDAPResultSizeLimitExceeded {
+			return code
+		}
+		ps = &pagedSearch{search: key, entries: entries, total: len(entries), result: code}
+	} else {
+		var ok bool
+		ps, ok = m.Client.client.takePagedSearch(string(paging.Cookie))
+		if !ok || ps.search != key {
+			return LDAPResultUnwillingToPerform
+		}
+	}
+
+	// a size of zero abandons the paged search
+	size := paging.Size
+	if size > len(ps.entries) {
+		size = len(ps.entries)
+	}
+	for _, entry := range ps.entries[:size] {
+		if m.Context().Err() != nil {
+			return LDAPResultSuccess
+		}
+		w.Write(entry)
+	}
+	ps.entries = ps.entries[size:]
+
+	response := PagingControl{Size: ps.total}
+	if paging.Size > 0 && len(ps.entries) > 0 {
+		ps.messageID = m.MessageID().Int()
+		ps.cookie = newPagingCookie()
+		m.Client.client.storePagedSearch(ps)
+		response.Cookie = []byte(ps.cookie)
+	}
+	w.AddControl(response.Control())
+	if response.Cookie != nil {
+		return LDAPResultSuccess
+	}
+	return ps.result
+}
+
+// pagedSearchKey identifies the parameters of a search, they must not
+// change between the pages of a paged search
+func pagedSearchKey(r ldap.SearchRequest) string {
+	attributes := make([]string, 0, len(r.Attributes()))
+	for _, a := range r.Attributes() {
+		attributes = append(attributes, string(a))
+	}
+	return fmt.Sprintf("%s|%d|%d|%s|%s", strings.ToLower(string(r.BaseObject())), r.Scope(), r.DerefAliases(), r.FilterString(), strings.Join(attributes, ","))
+}
+
+func newPagingCookie() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (c *client) storePagedSearch(ps *pagedSearch) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.pagedSearches) >= maxPagedSearches {
+		c.pagedSearches = c.pagedSearches[1:]
+	}
+	c.pagedSearches = append(c.pagedSearches, ps)
+}
+
+// takePagedSearch removes the paged search identified by cookie from the
+// connection and returns it
+func (c *client) takePagedSearch(cookie string) (*pagedSearch, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i, ps := range c.pagedSearches {
+		if ps.cookie == cookie {
+			c.pagedSearches = append(c.pagedSearches[:i], c.pagedSearches[i+1:]...)
+			return ps, true
+		}
+	}
+	return nil, false
+}
+
+// abandonPagedSearch drops the paged search whose last page was returned
+// for messageID
+func (c *client) abandonPagedSearch(messageID int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i, ps := range c.pagedSearches {
+		if ps.messageID == messageID {
+			c.pagedSearches = append(c.pagedSearches[:i], c.pagedSearches[i+1:]...)
+			c.log.Debug("paged search abandoned", log.Ctx{"messageid": messageID})
+			return
+		}
+	}
+}
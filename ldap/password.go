@@ -0,0 +1,174 @@
+package ldap
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/jsimonetti/ldapserv/internal/ber"
+	ldap "github.com/lor00x/goldap/message"
+)
+
+// Password storage schemes supported by HashPassword, the scheme is the
+// prefix of the userPassword value
+const (
+	PasswordSchemeCleartext = "{CLEARTEXT}"
+	PasswordSchemeSHA       = "{SHA}"
+	PasswordSchemeSSHA      = "{SSHA}"
+	PasswordSchemeSHA256    = "{SHA256}"
+	PasswordSchemeSSHA256   = "{SSHA256}"
+	PasswordSchemeSHA512    = "{SHA512}"
+	PasswordSchemeSSHA512   = "{SSHA512}"
+)
+
+// passwordSaltSize is the size of the salt of the salted schemes
+const passwordSaltSize = 8
+
+type passwordScheme struct {
+	hash   func() hash.Hash
+	salted bool
+}
+
+var passwordSchemes = map[string]passwordScheme{
+	PasswordSchemeSHA:     {sha1.New, false},
+	PasswordSchemeSSHA:    {sha1.New, true},
+	PasswordSchemeSHA256:  {sha256.New, false},
+	PasswordSchemeSSHA256: {sha256.New, true},
+	PasswordSchemeSHA512:  {sha512.New, false},
+	PasswordSchemeSSHA512: {sha512.New, true},
+}
+
+// HashPassword returns the userPassword value storing password with the
+// scheme, the password is stored as is with PasswordSchemeCleartext or an
+// empty scheme
+func HashPassword(scheme string, password []byte) ([]byte, error) {
+	scheme = strings.ToUpper(scheme)
+	if scheme == "" || scheme == PasswordSchemeCleartext {
+		return append([]byte{}, password...), nil
+	}
+	s, ok := passwordSchemes[scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported password scheme %s", scheme)
+	}
+	var salt []byte
+	if s.salted {
+		salt = make([]byte, passwordSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+	}
+	digest := passwordDigest(s, password, salt)
+	return []byte(scheme + base64.StdEncoding.EncodeToString(append(digest, salt...))), nil
+}
+
+// CheckPassword returns true when password matches the userPassword value
+// stored, either in cleartext or hashed with one of the supported schemes
+func CheckPassword(stored, password []byte) bool {
+	if len(stored) == 0 {
+		return false
+	}
+	if stored[0] != '{' {
+		return subtle.ConstantTimeCompare(stored, password) == 1
+	}
+	end := bytes.IndexByte(stored, '}')
+	if end < 0 {
+		return subtle.ConstantTimeCompare(stored, password) == 1
+	}
+	scheme := strings.ToUpper(string(stored[:end+1]))
+	if scheme == PasswordSchemeCleartext {
+		return subtle.ConstantTimeCompare(stored[end+1:], password) == 1
+	}
+	s, ok := passwordSchemes[scheme]
+	if !ok {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(stored[end+1:]))
+	if err != nil {
+		return false
+	}
+	size := s.hash().Size()
+	if len(decoded) < size || (!s.salted && len(decoded) != size) {
+		return false
+	}
+	digest := passwordDigest(s, password, decoded[size:])
+	return subtle.ConstantTimeCompare(digest, decoded[:size]) == 1
+}
+
+func passwordDigest(s passwordScheme, password, salt []byte) []byte {
+	h := s.hash()
+	h.Write(password)
+	h.Write(salt)
+	return h.Sum(nil)
+}
+
+// GeneratePassword returns a random password
+func GeneratePassword() ([]byte, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return []byte(base64.RawURLEncoding.EncodeToString(b)), nil
+}
+
+// PasswordModifyRequest is the value of a Password Modify extended request,
+// the fields are nil when absent
+// @see RFC https://tools.ietf.org/html/rfc3062
+type PasswordModifyRequest struct {
+	UserIdentity []byte
+	OldPassword  []byte
+	NewPassword  []byte
+}
+
+// ParsePasswordModifyRequest decodes the value of a Password Modify
+// extended request, an absent value is an empty request
+//
+//	PasswdModifyRequestValue ::= SEQUENCE {
+//	        userIdentity    [0]  OCTET STRING OPTIONAL
+//	        oldPasswd       [1]  OCTET STRING OPTIONAL
+//	        newPasswd       [2]  OCTET STRING OPTIONAL }
+func ParsePasswordModifyRequest(m *Message) (PasswordModifyRequest, error) {
+	var p PasswordModifyRequest
+	r := m.GetExtendedRequest()
+	value := r.RequestValue()
+	if value == nil {
+		return p, nil
+	}
+	elements, err := ber.DecodeSequence([]byte(*value))
+	if err != nil {
+		return p, err
+	}
+	for _, e := range elements {
+		content := append([]byte{}, e.Content...)
+		switch e.Tag {
+		case ber.ClassContext | 0:
+			p.UserIdentity = content
+		case ber.ClassContext | 1:
+			p.OldPassword = content
+		case ber.ClassContext | 2:
+			p.NewPassword = content
+		default:
+			return p, fmt.Errorf("invalid password modify request element %#x", e.Tag)
+		}
+	}
+	return p, nil
+}
+
+// NewPasswordModifyResponse returns the response to a Password Modify
+// extended request, the responseValue holds the generated password when
+// genPasswd is not nil and is absent otherwise
+//
+//	PasswdModifyResponseValue ::= SEQUENCE {
+//	        genPasswd       [0]     OCTET STRING OPTIONAL }
+func NewPasswordModifyResponse(resultCode int, genPasswd []byte) ldap.ExtendedResponse {
+	if genPasswd == nil {
+		return NewExtendedResponse(resultCode)
+	}
+	return NewExtendedResponseWithValue(resultCode, "", ber.Sequence(ber.Encode(ber.ClassContext|0, genPasswd)))
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package ldap
+
+import (
+	"errors"
+	"net"
+)
+
+// peerCredentials is only implemented on Linux
+func peerCredentials(conn *net.UnixConn) (*PeerCred, error) {
+	return nil, errors.New("peer credentials are not supported on this platform")
+}
@@ -0,0 +1,276 @@
+package ldap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// ProxyHeaderTimeout is how long a load balancer has to send the PROXY
+// protocol header once connected
+var ProxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature starts the binary PROXY protocol header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocol returns a listener option reading the PROXY protocol v1 or
+// v2 header sent by the load balancers of the trusted networks, see
+// NewProxyListener. It applies to the listener of the ListenAndServe call
+// it is given to, under the TLS layer for ListenAndServeTLS.
+func ProxyProtocol(trusted []*net.IPNet) func(*Server) {
+	return func(s *Server) {
+		s.Listener = NewProxyListener(s.Listener, trusted, s.log)
+	}
+}
+
+// ParseNetworks parses a list of CIDR networks, a single address is a
+// network of one address
+func ParseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// NewProxyListener returns a listener expecting a PROXY protocol header
+// from the connections of the trusted networks. The addresses of these
+// connections are the ones of the real client and server found in the
+// header, the connection fails when the header is missing or invalid.
+// The connections from the other networks are returned unchanged.
+// @see http://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+func NewProxyListener(ln net.Listener, trusted []*net.IPNet, logger log.Logger) net.Listener {
+	return &proxyListener{Listener: ln, trusted: trusted, log: logger}
+}
+
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	log     log.Logger
+}
+
+// Accept does not wait for the header, it is read by the goroutine of the
+// client on the first use of the connection
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil || !l.isTrusted(conn.RemoteAddr()) {
+		return conn, err
+	}
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn), log: l.log}, nil
+}
+
+func (l *proxyListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range l.trusted {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn is a connection from a load balancer, its addresses are the
+// ones found in the PROXY protocol header
+type proxyConn struct {
+	net.Conn
+	r   *bufio.Reader
+	log log.Logger
+
+	once   sync.Once
+	err    error
+	remote net.Addr
+	local  net.Addr
+
+	// deadline is the read deadline set by the server, restored once the
+	// header is read
+	mutex    sync.Mutex
+	deadline time.Time
+}
+
+func (p *proxyConn) SetDeadline(t time.Time) error {
+	p.mutex.Lock()
+	p.deadline = t
+	p.mutex.Unlock()
+	return p.Conn.SetDeadline(t)
+}
+
+func (p *proxyConn) SetReadDeadline(t time.Time) error {
+	p.mutex.Lock()
+	p.deadline = t
+	p.mutex.Unlock()
+	return p.Conn.SetReadDeadline(t)
+}
+
+func (p *proxyConn) Read(b []byte) (int, error) {
+	p.init()
+	if p.err != nil {
+		return 0, p.err
+	}
+	return p.r.Read(b)
+}
+
+// RemoteAddr returns the address of the real client, the one of the load
+// balancer when the header carries none
+func (p *proxyConn) RemoteAddr() net.Addr {
+	p.init()
+	if p.remote != nil {
+		return p.remote
+	}
+	return p.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the real client connected to
+func (p *proxyConn) LocalAddr() net.Addr {
+	p.init()
+	if p.local != nil {
+		return p.local
+	}
+	return p.Conn.LocalAddr()
+}
+
+func (p *proxyConn) init() {
+	p.once.Do(func() {
+		p.Conn.SetReadDeadline(time.Now().Add(ProxyHeaderTimeout))
+		p.err = p.readHeader()
+		p.mutex.Lock()
+		p.Conn.SetReadDeadline(p.deadline)
+		p.mutex.Unlock()
+		if p.err != nil {
+			p.log.Info("invalid PROXY protocol header", log.Ctx{"addr": p.Conn.RemoteAddr().String(), "error": p.err})
+		}
+	})
+}
+
+func (p *proxyConn) readHeader() error {
+	prefix, err := p.r.Peek(len("PROXY"))
+	if err != nil {
+		return err
+	}
+	if string(prefix) == "PROXY" {
+		return p.readHeaderV1()
+	}
+	signature, err := p.r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(signature, proxyV2Signature) {
+		return p.readHeaderV2()
+	}
+	return errors.New("missing PROXY protocol header")
+}
+
+// readHeaderV1 reads the text header, ie
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 389\r\n"
+func (p *proxyConn) readHeaderV1() error {
+	// the header is at most 107 bytes long
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= 107 {
+			return errors.New("PROXY protocol v1 header too long")
+		}
+		b, err := p.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || fields[0] != "PROXY" || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return fmt.Errorf("invalid PROXY protocol v1 header %q", strings.TrimSpace(string(line)))
+	}
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || err1 != nil || err2 != nil {
+		return fmt.Errorf("invalid PROXY protocol v1 header %q", strings.TrimSpace(string(line)))
+	}
+	p.remote = &net.TCPAddr{IP: src, Port: int(srcPort)}
+	p.local = &net.TCPAddr{IP: dst, Port: int(dstPort)}
+	return nil
+}
+
+// readHeaderV2 reads the binary header, the TLVs following the addresses
+// are skipped
+func (p *proxyConn) readHeaderV2() error {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(p.r, header); err != nil {
+		return err
+	}
+	versionCommand, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:]))
+	if versionCommand>>4 != 2 {
+		return fmt.Errorf("unsupported PROXY protocol version %d", versionCommand>>4)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(p.r, payload); err != nil {
+		return err
+	}
+
+	switch versionCommand & 0x0f {
+	case 0x0: // LOCAL, ie a health check of the load balancer
+		return nil
+	case 0x1: // PROXY
+	default:
+		return fmt.Errorf("unsupported PROXY protocol command %d", versionCommand&0x0f)
+	}
+
+	var size int
+	switch family {
+	case 0x11: // TCP over IPv4
+		size = net.IPv4len
+	case 0x21: // TCP over IPv6
+		size = net.IPv6len
+	default:
+		// unspecified or not TCP, the addresses are not usable
+		return nil
+	}
+	if length < 2*size+4 {
+		return errors.New("PROXY protocol v2 header too short")
+	}
+	p.remote = &net.TCPAddr{
+		IP:   net.IP(payload[:size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size:])),
+	}
+	p.local = &net.TCPAddr{
+		IP:   net.IP(payload[size : 2*size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size+2:])),
+	}
+	return nil
+}
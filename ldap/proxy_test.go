@@ -0,0 +1,302 @@
+package ldap
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyAddrs are the addresses of a connection as seen by the handlers
+type proxyAddrs struct {
+	remote, local string
+}
+
+// newProxyTestServer returns a server sending the addresses of the
+// connections of its requests to addrs
+func newProxyTestServer(addrs chan proxyAddrs) *Server {
+	return newTestServer(func(w ResponseWriter, m *Message) {
+		conn := m.Client.client.GetConn()
+		addrs <- proxyAddrs{remote: m.Client.RemoteAddr().String(), local: conn.LocalAddr().String()}
+		w.Write(NewSearchResultDoneResponse(LDAPResultSuccess))
+	})
+}
+
+func mustParseNetworks(t *testing.T, cidrs ...string) []*net.IPNet {
+	t.Helper()
+	networks, err := ParseNetworks(cidrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return networks
+}
+
+// proxyV2Header returns a binary header of the command with the payload of
+// the address family
+func proxyV2Header(command, family byte, payload []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(payload)))
+	return append(header, payload...)
+}
+
+// proxyV2TCP4 returns the payload of a TCP over IPv4 connection
+func proxyV2TCP4(src, dst string, srcPort, dstPort uint16) []byte {
+	payload := append(net.ParseIP(src).To4(), net.ParseIP(dst).To4()...)
+	payload = append(payload, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(payload[8:], srcPort)
+	binary.BigEndian.PutUint16(payload[10:], dstPort)
+	return payload
+}
+
+func TestProxyProtocol(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		// remote and local are the addresses seen by the handler, the ones
+		// of the TCP connection when empty
+		remote, local string
+	}{
+		{
+			name:   "v1 TCP4",
+			header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 389\r\n"),
+			remote: "192.0.2.1:56324",
+			local:  "198.51.100.1:389",
+		},
+		{
+			name:   "v1 TCP6",
+			header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 389\r\n"),
+			remote: "[2001:db8::1]:56324",
+			local:  "[2001:db8::2]:389",
+		},
+		{
+			name:   "v1 UNKNOWN",
+			header: []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"),
+		},
+		{
+			name:   "v2 PROXY",
+			header: proxyV2Header(0x1, 0x11, proxyV2TCP4("192.0.2.1", "198.51.100.1", 56324, 389)),
+			remote: "192.0.2.1:56324",
+			local:  "198.51.100.1:389",
+		},
+		{
+			name:   "v2 PROXY with TLVs",
+			header: proxyV2Header(0x1, 0x11, append(proxyV2TCP4("192.0.2.1", "198.51.100.1", 56324, 389), 0x04, 0, 1, 0)),
+			remote: "192.0.2.1:56324",
+			local:  "198.51.100.1:389",
+		},
+		{
+			name:   "v2 LOCAL",
+			header: proxyV2Header(0x0, 0x00, nil),
+		},
+		{
+			name:   "v2 LOCAL with addresses",
+			header: proxyV2Header(0x0, 0x11, proxyV2TCP4("192.0.2.1", "198.51.100.1", 56324, 389)),
+		},
+		{
+			name:   "v2 unspecified family",
+			header: proxyV2Header(0x1, 0x00, nil),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addrs := make(chan proxyAddrs, 1)
+			s := newProxyTestServer(addrs)
+			addr := serveTCP(t, s, ProxyProtocol(mustParseNetworks(t, "127.0.0.0/8")))
+
+			c := dialTest(t, "tcp", addr)
+			if _, err := c.conn.Write(tt.header); err != nil {
+				t.Fatal(err)
+			}
+			c.search(1, "")
+			if _, code := c.readResult(); code != LDAPResultSuccess {
+				t.Fatalf("got result %d, want success", code)
+			}
+
+			got := <-addrs
+			remote, local := tt.remote, tt.local
+			if remote == "" {
+				remote, local = c.conn.LocalAddr().String(), c.conn.RemoteAddr().String()
+			}
+			if got.remote != remote || got.local != local {
+				t.Errorf("got remote %s and local %s, want %s and %s", got.remote, got.local, remote, local)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		// closeWrite ends the header with the end of the stream
+		closeWrite bool
+	}{
+		{
+			name:   "missing header",
+			header: nil,
+		},
+		{
+			name:   "v1 line too long",
+			header: []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"),
+		},
+		{
+			name:   "v1 invalid address",
+			header: []byte("PROXY TCP4 192.0.2.300 198.51.100.1 56324 389\r\n"),
+		},
+		{
+			name:   "v1 invalid port",
+			header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 65536 389\r\n"),
+		},
+		{
+			name:   "v1 missing field",
+			header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n"),
+		},
+		{
+			name:   "v1 unsupported protocol",
+			header: []byte("PROXY UDP4 192.0.2.1 198.51.100.1 56324 389\r\n"),
+		},
+		{
+			name:   "v2 payload too short for the family",
+			header: proxyV2Header(0x1, 0x11, proxyV2TCP4("192.0.2.1", "198.51.100.1", 56324, 389)[:8]),
+		},
+		{
+			name:       "v2 truncated payload",
+			header:     proxyV2Header(0x1, 0x11, proxyV2TCP4("192.0.2.1", "198.51.100.1", 56324, 389))[:len(proxyV2Signature)+4+6],
+			closeWrite: true,
+		},
+		{
+			name:   "v2 unsupported version",
+			header: append(append(append([]byte{}, proxyV2Signature...), 0x11, 0x11, 0, 12), proxyV2TCP4("192.0.2.1", "198.51.100.1", 56324, 389)...),
+		},
+		{
+			name:   "v2 unsupported command",
+			header: proxyV2Header(0x2, 0x11, proxyV2TCP4("192.0.2.1", "198.51.100.1", 56324, 389)),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addrs := make(chan proxyAddrs, 1)
+			s := newProxyTestServer(addrs)
+			addr := serveTCP(t, s, ProxyProtocol(mustParseNetworks(t, "127.0.0.0/8")))
+
+			c := dialTest(t, "tcp", addr)
+			if _, err := c.conn.Write(tt.header); err != nil {
+				t.Fatal(err)
+			}
+			if tt.closeWrite {
+				c.conn.(*net.TCPConn).CloseWrite()
+			} else {
+				c.search(1, "")
+			}
+			c.expectClosed()
+			select {
+			case got := <-addrs:
+				t.Errorf("request served from %s", got.remote)
+			default:
+			}
+		})
+	}
+}
+
+func TestProxyProtocolUntrusted(t *testing.T) {
+	addrs := make(chan proxyAddrs, 1)
+	s := newProxyTestServer(addrs)
+	addr := serveTCP(t, s, ProxyProtocol(mustParseNetworks(t, "10.0.0.0/8")))
+
+	// the connections from other networks are served as is
+	c := dialTest(t, "tcp", addr)
+	c.search(1, "")
+	if _, code := c.readResult(); code != LDAPResultSuccess {
+		t.Fatalf("got result %d, want success", code)
+	}
+	if got := <-addrs; got.remote != c.conn.LocalAddr().String() {
+		t.Errorf("got remote %s, want %s", got.remote, c.conn.LocalAddr())
+	}
+
+	// and their header is not honoured, it is a malformed LDAP message
+	c = dialTest(t, "tcp", addr)
+	c.conn.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 389\r\n"))
+	c.search(1, "")
+	if code := c.readNotice(); code != LDAPResultProtocolError {
+		t.Errorf("got result %d, want protocolError", code)
+	}
+	c.expectClosed()
+	select {
+	case got := <-addrs:
+		t.Errorf("request served from %s", got.remote)
+	default:
+	}
+}
+
+func TestProxyProtocolDeadline(t *testing.T) {
+	defer func(timeout time.Duration) { ProxyHeaderTimeout = timeout }(ProxyHeaderTimeout)
+	ProxyHeaderTimeout = 100 * time.Millisecond
+
+	addrs := make(chan proxyAddrs, 2)
+	s := newProxyTestServer(addrs)
+	addr := serveTCP(t, s, ProxyProtocol(mustParseNetworks(t, "127.0.0.0/8")))
+
+	// the header must come in time
+	c := dialTest(t, "tcp", addr)
+	time.Sleep(2 * ProxyHeaderTimeout)
+	c.conn.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 389\r\n"))
+	c.expectClosed()
+
+	// the deadline of the server, none here, is restored once the header
+	// is read
+	c = dialTest(t, "tcp", addr)
+	c.conn.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 389\r\n"))
+	time.Sleep(2 * ProxyHeaderTimeout)
+	c.search(1, "")
+	if _, code := c.readResult(); code != LDAPResultSuccess {
+		t.Fatalf("got result %d, want success", code)
+	}
+	if got := <-addrs; got.remote != "192.0.2.1:56324" {
+		t.Errorf("got remote %s, want 192.0.2.1:56324", got.remote)
+	}
+}
+
+func TestProxyListenerIsTrusted(t *testing.T) {
+	l := &proxyListener{trusted: mustParseNetworks(t, "127.0.0.0/8", "192.0.2.0/24", "2001:db8::1")}
+	tests := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.200"), Port: 1}, true},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 1}, true},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}, true},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 1}, false},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.3.1"), Port: 1}, false},
+		{&net.TCPAddr{IP: net.ParseIP("::1"), Port: 1}, false},
+		{&net.UnixAddr{Name: "/run/ldapi", Net: "unix"}, false},
+	}
+	for _, tt := range tests {
+		if got := l.isTrusted(tt.addr); got != tt.want {
+			t.Errorf("isTrusted(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := ParseNetworks([]string{"10.0.0.0/8", " 192.0.2.1 ", "", "2001:db8::/32", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, n := range networks {
+		got = append(got, n.String())
+	}
+	want := []string{"10.0.0.0/8", "192.0.2.1/32", "2001:db8::/32", "::1/128"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, invalid := range []string{"10.0.0.0/33", "192.0.2", "example.org"} {
+		if _, err := ParseNetworks([]string{invalid}); err == nil {
+			t.Errorf("ParseNetworks(%q) succeeded, want an error", invalid)
+		}
+	}
+}
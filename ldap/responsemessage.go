@@ -1,6 +1,9 @@
 package ldap
 
-import ldap "github.com/lor00x/goldap/message"
+import (
+	"github.com/jsimonetti/ldapserv/internal/ber"
+	ldap "github.com/lor00x/goldap/message"
+)
 
 func NewBindResponse(resultCode int) ldap.BindResponse {
 	r := ldap.BindResponse{}
@@ -38,6 +41,12 @@ func NewDeleteResponse(resultCode int) ldap.DelResponse {
 	return r
 }
 
+func NewModifyDNResponse(resultCode int) ldap.ModifyDNResponse {
+	r := ldap.LDAPResult{}
+	r.SetResultCode(resultCode)
+	return ldap.ModifyDNResponse(r)
+}
+
 func NewAddResponse(resultCode int) ldap.AddResponse {
 	r := ldap.AddResponse{}
 	r.SetResultCode(resultCode)
@@ -55,3 +64,93 @@ func NewSearchResultEntry(objectname string) ldap.SearchResultEntry {
 	r.SetObjectName(objectname)
 	return r
 }
+
+// NewResponseForRequest returns the response matching the request type of m,
+// or nil when the request does not expect any response
+func NewResponseForRequest(m *Message, resultCode int, diagnosticMessage string) ldap.ProtocolOp {
+	r := ldap.LDAPResult{}
+	r.SetResultCode(resultCode)
+	r.SetDiagnosticMessage(diagnosticMessage)
+
+	switch m.ProtocolOp().(type) {
+	case ldap.BindRequest:
+		return ldap.BindResponse{LDAPResult: r}
+	case ldap.SearchRequest:
+		return ldap.SearchResultDone(r)
+	case ldap.ModifyRequest:
+		return ldap.ModifyResponse(r)
+	case ldap.AddRequest:
+		return ldap.AddResponse(r)
+	case ldap.DelRequest:
+		return ldap.DelResponse(r)
+	case ldap.ModifyDNRequest:
+		return ldap.ModifyDNResponse(r)
+	case ldap.CompareRequest:
+		return ldap.CompareResponse(r)
+	case ldap.ExtendedRequest:
+		return ldap.ExtendedResponse{LDAPResult: r}
+	case ldap.AbandonRequest, ldap.UnbindRequest:
+		return nil
+	}
+	return r
+}
+
+// NewSASLBindResponse returns a BindResponse carrying the server SASL
+// credentials, serverSaslCreds is omitted when nil
+func NewSASLBindResponse(resultCode int, serverSaslCreds []byte) ldap.BindResponse {
+	if serverSaslCreds == nil {
+		return NewBindResponse(resultCode)
+	}
+	op := ber.Encode(ber.ClassApplication|ber.Constructed|ldap.TagBindResponse, ber.Concat(
+		encodeLDAPResult(resultCode, "", ""),
+		ber.Encode(ber.ClassContext|ldap.TagBindResponseServerSaslCreds, serverSaslCreds),
+	))
+	po, err := decodeProtocolOp(op)
+	if err != nil {
+		return NewBindResponse(resultCode)
+	}
+	return po.(ldap.BindResponse)
+}
+
+// NewExtendedResponseWithValue returns an ExtendedResponse carrying a
+// responseValue, responseName is omitted when empty
+func NewExtendedResponseWithValue(resultCode int, responseName ldap.LDAPOID, responseValue []byte) ldap.ExtendedResponse {
+	var elements [][]byte
+	elements = append(elements, encodeLDAPResult(resultCode, "", ""))
+	if responseName != "" {
+		elements = append(elements, ber.Encode(ber.ClassContext|ldap.TagExtendedResponseName, []byte(responseName)))
+	}
+	elements = append(elements, ber.Encode(ber.ClassContext|ldap.TagExtendedResponseValue, responseValue))
+	op := ber.Encode(ber.ClassApplication|ber.Constructed|ldap.TagExtendedResponse, ber.Concat(elements...))
+	po, err := decodeProtocolOp(op)
+	if err != nil {
+		r := NewExtendedResponse(resultCode)
+		if responseName != "" {
+			r.SetResponseName(responseName)
+		}
+		return r
+	}
+	return po.(ldap.ExtendedResponse)
+}
+
+// ResultCode returns the result code of a response, ok is false when the
+// protocol op is not an LDAPResult based response
+func ResultCode(po ldap.ProtocolOp) (code int, ok bool) {
+	switch po.(type) {
+	case ldap.SearchResultEntry, ldap.SearchResultReference, ldap.IntermediateResponse:
+		return 0, false
+	}
+	op, err := encodeProtocolOp(po)
+	if err != nil || op.Tag&ber.Constructed == 0 {
+		return 0, false
+	}
+	e, _, err := ber.Decode(op.Content)
+	if err != nil || e.Tag != ber.TagEnumerated {
+		return 0, false
+	}
+	v, err := e.Int()
+	if err != nil {
+		return 0, false
+	}
+	return int(v), true
+}
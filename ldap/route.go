@@ -1,9 +1,12 @@
 package ldap
 
 import (
+	"fmt"
+	"sort"
 	"strings"
-	"unicode/utf8"
 
+	"github.com/jsimonetti/ldapserv/dn"
+	"github.com/jsimonetti/ldapserv/filter"
 	ldap "github.com/lor00x/goldap/message"
 	log "gopkg.in/inconshreveable/log15.v2"
 )
@@ -16,6 +19,7 @@ const (
 	ADD      = "AddRequest"
 	MODIFY   = "ModifyRequest"
 	DELETE   = "DelRequest"
+	MODIFYDN = "ModifyDNRequest"
 	EXTENDED = "ExtendedRequest"
 	ABANDON  = "AbandonRequest"
 )
@@ -30,22 +34,35 @@ type HandlerFunc func(ResponseWriter, *Message)
 type RouteMux struct {
 	routes        []*route
 	notFoundRoute *route
+	middlewares   []Middleware
 	Log           log.Logger
 }
 
+// name returns the label of the route, its operation when it has none
+func (r *route) name() string {
+	if r.label != "" {
+		return r.label
+	}
+	return r.operation
+}
+
 type route struct {
+	mux         *RouteMux
+	index       int
 	label       string
 	operation   string
 	handler     HandlerFunc
 	exoName     string
-	sBasedn     string
+	baseDn      dn.DN
 	uBasedn     bool
-	sFilter     string
+	sFilter     ldap.Filter
 	uFilter     bool
 	sScope      int
 	uScope      bool
 	sAuthChoice string
 	uAuthChoice bool
+	controls    []string
+	middlewares []Middleware
 }
 
 // Match return true when the *Message matches the route
@@ -63,7 +80,7 @@ func (r *route) Match(m *Message) bool {
 			}
 		}
 		if r.uBasedn == true {
-			if !strings.HasSuffix(string(v.Name()), r.sBasedn) {
+			if !r.matchesBaseDn(string(v.Name())) {
 				return false
 			}
 		}
@@ -77,13 +94,13 @@ func (r *route) Match(m *Message) bool {
 
 	case ldap.SearchRequest:
 		if r.uBasedn == true {
-			if strings.ToLower(string(v.BaseObject())) != r.sBasedn {
+			if !r.matchesBaseDn(string(v.BaseObject())) {
 				return false
 			}
 		}
 
 		if r.uFilter == true {
-			if strings.ToLower(v.FilterString()) != r.sFilter {
+			if !filter.Equal(v.Filter(), r.sFilter) {
 				return false
 			}
 		}
@@ -94,44 +111,149 @@ func (r *route) Match(m *Message) bool {
 			}
 		}
 		return true
+
+	case ldap.AddRequest, ldap.DelRequest, ldap.ModifyRequest, ldap.CompareRequest, ldap.ModifyDNRequest:
+		if r.uBasedn == true {
+			entry, ok := targetDN(m)
+			if !ok || !r.matchesBaseDn(entry) {
+				return false
+			}
+		}
+		return true
 	}
 	return true
 }
 
+// matchesBaseDn returns true when dn is the base DN of the route or one
+// of its descendants. The empty base DN only matches the root DSE.
+func (r *route) matchesBaseDn(s string) bool {
+	d, err := dn.Parse(s)
+	if err != nil || r.baseDn == nil {
+		return false
+	}
+	if len(r.baseDn) == 0 {
+		return len(d) == 0
+	}
+	return d.InSubtree(r.baseDn)
+}
+
+// targetDN returns the DN of the entry an update or compare request
+// applies to, the entry renamed by a ModifyDN request
+func targetDN(m *Message) (string, bool) {
+	switch v := m.ProtocolOp().(type) {
+	case ldap.AddRequest:
+		return string(v.Entry()), true
+	case ldap.DelRequest:
+		return string(v), true
+	case ldap.ModifyRequest:
+		return string(v.Object()), true
+	case ldap.CompareRequest:
+		return string(v.Entry()), true
+	case ldap.ModifyDNRequest:
+		req, err := ParseModifyDNRequest(m)
+		return req.Entry, err == nil
+	}
+	return "", false
+}
+
+// Use adds middlewares wrapping the route handler, they run after the
+// middlewares of the RouteMux
+func (r *route) Use(middlewares ...Middleware) *route {
+	r.middlewares = append(r.middlewares, middlewares...)
+	return r
+}
+
 func (r *route) Label(label string) *route {
 	r.label = label
 	return r
 }
 
-func (r *route) BaseDn(dn string) *route {
-	r.sBasedn = strings.ToLower(dn)
+// BaseDn restricts the route to the requests on the entry dn and its
+// subtree: the base object of a search, the name of a bind and the entry
+// of an update or a compare. The empty DN only matches the root DSE.
+// BaseDn panics when dn is invalid.
+func (r *route) BaseDn(s string) *route {
+	baseDn, err := dn.Parse(s)
+	if err != nil {
+		panic(fmt.Sprintf("LDAP: invalid route base DN %q: %s", s, err))
+	}
+	r.baseDn = baseDn
 	r.uBasedn = true
+	r.rank()
 	return r
 }
 
 func (r *route) AuthenticationChoice(choice string) *route {
 	r.sAuthChoice = strings.ToLower(choice)
 	r.uAuthChoice = true
+	r.rank()
 	return r
 }
 
+// Filter restricts the route to the searches whose filter is pattern,
+// once both are normalized, see filter.Equal. Filter panics when pattern
+// is invalid.
 func (r *route) Filter(pattern string) *route {
-	r.sFilter = strings.ToLower(pattern)
+	f, err := filter.Compile(pattern)
+	if err != nil {
+		panic(fmt.Sprintf("LDAP: invalid route filter %q: %s", pattern, err))
+	}
+	r.sFilter = f
 	r.uFilter = true
+	r.rank()
 	return r
 }
 
 func (r *route) Scope(scope int) *route {
 	r.sScope = scope
 	r.uScope = true
+	r.rank()
 	return r
 }
 
 func (r *route) RequestName(name ldap.LDAPOID) *route {
 	r.exoName = string(name)
+	r.rank()
+	return r
+}
+
+// rank sorts the routes of the RouteMux again once the conditions of the
+// route changed
+func (r *route) rank() {
+	if r.mux != nil {
+		r.mux.sortRoutes()
+	}
+}
+
+// Controls declares the request controls supported by the route handler.
+// A request with a critical control the route does not support is
+// answered with unavailableCriticalExtension.
+func (r *route) Controls(oids ...string) *route {
+	r.controls = append(r.controls, oids...)
 	return r
 }
 
+// unsupportedCriticalControl returns the first critical control of the
+// message not supported by the route
+func (r *route) unsupportedCriticalControl(m *Message) (Control, bool) {
+	for _, c := range m.RequestControls() {
+		if !c.Criticality {
+			continue
+		}
+		supported := false
+		for _, oid := range r.controls {
+			if oid == c.OID {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return c, true
+		}
+	}
+	return Control{}, false
+}
+
 // NewRouteMux returns a new *RouteMux
 // RouteMux implements ldapserver.Handler
 func NewRouteMux(logger log.Logger) *RouteMux {
@@ -145,23 +267,37 @@ type Handler interface {
 	ServeLDAP(w ResponseWriter, r *Message)
 }
 
+// Use adds middlewares wrapping every request served by the RouteMux,
+// including the ones no route matches. The first middleware added is the
+// outermost one.
+func (h *RouteMux) Use(middlewares ...Middleware) {
+	h.middlewares = append(h.middlewares, middlewares...)
+}
+
 // ServeLDAP dispatches the request to the handler whose
 // pattern most closely matches the request request Message.
 func (h *RouteMux) ServeLDAP(w ResponseWriter, r *Message) {
+	chain(h.middlewares, HandlerFunc(h.dispatch)).ServeLDAP(w, r)
+}
 
-	//find a matching Route
-	for _, route := range h.routes {
+// dispatch serves the request with the most specific matching route
+func (h *RouteMux) dispatch(w ResponseWriter, r *Message) {
 
-		//if the route don't match, skip it
-		if route.Match(r) == false {
-			continue
+	//find the most specific matching Route, the routes are sorted
+	var match *route
+	for _, route := range h.routes {
+		if route.Match(r) {
+			match = route
+			break
 		}
+	}
 
-		if route.label != "" {
-			h.Log.Debug("ROUTE MATCH", log.Ctx{"label": route.label})
+	if match != nil {
+		if match.label != "" {
+			h.Log.Debug("ROUTE MATCH", log.Ctx{"label": match.label})
 		}
 
-		route.handler(w, r)
+		h.serveRoute(match, w, r)
 		return
 	}
 
@@ -176,50 +312,114 @@ func (h *RouteMux) ServeLDAP(w ResponseWriter, r *Message) {
 
 	if h.notFoundRoute != nil {
 		h.Log.Debug("no match, running notFoundRoute")
-		h.notFoundRoute.handler(w, r)
+		h.serveRoute(h.notFoundRoute, w, r)
 	} else {
 		h.Log.Debug("no match, running default notFound")
+		r.route = "none"
 		res := NewResponse(LDAPResultUnwillingToPerform)
 		res.SetDiagnosticMessage("Operation not implemented by server")
 		w.Write(res)
 	}
 }
 
+// serveRoute runs the route middlewares and handler, the handler runs
+// once the request controls are checked
+func (h *RouteMux) serveRoute(route *route, w ResponseWriter, r *Message) {
+	r.route = route.name()
+	chain(route.middlewares, HandlerFunc(func(w ResponseWriter, r *Message) {
+		h.serveHandler(route, w, r)
+	})).ServeLDAP(w, r)
+}
+
+// serveHandler runs the route handler once the request controls are checked
+func (h *RouteMux) serveHandler(route *route, w ResponseWriter, r *Message) {
+	if c, ok := route.unsupportedCriticalControl(r); ok {
+		h.Log.Debug("unsupported critical control", log.Ctx{"oid": c.OID})
+		if res := NewResponseForRequest(r, LDAPResultUnavailableCriticalExtension, "unsupported critical control "+c.OID); res != nil {
+			w.Write(res)
+		}
+		return
+	}
+	route.handler(w, r)
+}
+
+// SupportedControls returns the OIDs of the controls supported by at least
+// one route, suitable for the supportedControl attribute of the root DSE
+func (h *RouteMux) SupportedControls() []string {
+	var oids []string
+	seen := make(map[string]bool)
+	routes := h.routes
+	if h.notFoundRoute != nil {
+		routes = append(routes[:len(routes):len(routes)], h.notFoundRoute)
+	}
+	for _, route := range routes {
+		for _, oid := range route.controls {
+			if !seen[oid] {
+				seen[oid] = true
+				oids = append(oids, oid)
+			}
+		}
+	}
+	return oids
+}
+
+// SupportedExtensions returns the names of the extended operations routed
+// to a backend, suitable for the supportedExtension attribute of the root
+// DSE
+func (h *RouteMux) SupportedExtensions() []string {
+	var oids []string
+	seen := make(map[string]bool)
+	for _, route := range h.routes {
+		if route.operation == EXTENDED && route.exoName != "" && !seen[route.exoName] {
+			seen[route.exoName] = true
+			oids = append(oids, route.exoName)
+		}
+	}
+	return oids
+}
+
 // Adds a new Route to the Handler
+// The routes are kept sorted from the most specific one, see moreSpecific,
+// and sorted again when the conditions of a route are set
 func (h *RouteMux) addRoute(r *route) {
-	//and finally append to the list of Routes
-	//create the Route
+	r.mux = h
+	r.index = len(h.routes)
 	h.routes = append(h.routes, r)
+	h.sortRoutes()
+}
 
-	// sorts routes based on following criteria:
-	// - longest basedn on top
-	// - authchoice, filter and scope are ignored for now
-	/*
-	   sBasedn     string
-	   uBasedn     bool
-	*/
-
-	var i, j int
-
-	exchanges := true
-	passnum := len(h.routes) - 1
-	for passnum > 0 && exchanges {
-		exchanges = false
-		for i = 0; i < passnum; i++ {
-			if h.routes[i].uBasedn == true {
-				if h.routes[i+1].uBasedn == false || utf8.RuneCountInString(h.routes[i].sBasedn) > utf8.RuneCountInString(h.routes[i+1].sBasedn) {
-					h.routes[i], h.routes[i+1] = h.routes[i+1], h.routes[i]
-					exchanges = true
-				}
-			}
-		}
-		passnum = passnum - 1
+func (h *RouteMux) sortRoutes() {
+	sort.SliceStable(h.routes, func(i, j int) bool {
+		return h.routes[i].moreSpecific(h.routes[j])
+	})
+}
+
+// moreSpecific returns true when the route r has precedence over the
+// route o: the deepest basedn wins, then the route with the most
+// conditions. Routes of the same rank keep the order they were added in.
+func (r *route) moreSpecific(o *route) bool {
+	if r.uBasedn != o.uBasedn {
+		return r.uBasedn
 	}
+	if lr, lo := len(r.baseDn), len(o.baseDn); lr != lo {
+		return lr > lo
+	}
+	if cr, co := r.conditions(), o.conditions(); cr != co {
+		return cr > co
+	}
+	return r.index < o.index
+}
 
-	//reverse it
-	for i, j = 0, len(h.routes)-1; i < j; i, j = i+1, j-1 {
-		h.routes[i], h.routes[j] = h.routes[j], h.routes[i]
+// conditions returns the number of conditions of the route besides the
+// basedn
+func (r *route) conditions() int {
+	n := 0
+	for _, set := range []bool{r.uFilter, r.uScope, r.uAuthChoice, r.exoName != ""} {
+		if set {
+			n++
+		}
 	}
+	return n
 }
 
 func (h *RouteMux) NotFound(backend Backend) *route {
@@ -269,6 +469,14 @@ func (h *RouteMux) Modify(backend Backend) *route {
 	return route
 }
 
+func (h *RouteMux) ModifyDN(backend Backend) *route {
+	route := &route{}
+	route.operation = MODIFYDN
+	route.handler = backend.ModifyDN
+	h.addRoute(route)
+	return route
+}
+
 func (h *RouteMux) Compare(backend Backend) *route {
 	route := &route{}
 	route.operation = COMPARE
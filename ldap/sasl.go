@@ -0,0 +1,226 @@
+package ldap
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jsimonetti/ldapserv/internal/ber"
+	ldap "github.com/lor00x/goldap/message"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// SASLMechanism is a SASL authentication mechanism which can be
+// registered with RegisterSASLMechanism
+// @see RFC https://tools.ietf.org/html/rfc4513#section-5.2
+type SASLMechanism interface {
+	// Name returns the registered SASL mechanism name, ie "PLAIN"
+	Name() string
+	// Start begins a new authentication exchange on a connection
+	Start(ctx SASLContext) SASLConversation
+}
+
+// SASLConversation is the server side of a SASL authentication exchange.
+// It lives on the client connection between the saslBindInProgress round
+// trips.
+type SASLConversation interface {
+	// Next consumes the credentials sent by the client (nil when absent)
+	// and returns the credentials to send back. done is true once the
+	// client is authenticated. An error ends the exchange, a *SASLError
+	// carries the result code sent to the client.
+	Next(credentials []byte) (challenge []byte, done bool, err error)
+	// AuthzID returns the authorization identity, ie "dn:cn=admin,dc=org"
+	// or "u:admin", once the exchange is done
+	AuthzID() string
+}
+
+// SASLUserStore is implemented by the backends to let the SASL
+// mechanisms authenticate their users
+type SASLUserStore interface {
+	// LookupUser maps a SASL authentication identity to the DN of the
+	// user and returns its userPassword values
+	LookupUser(authcid string) (dn string, passwords [][]byte, ok bool)
+}
+
+// SASLContext is given to a mechanism when an exchange starts
+type SASLContext struct {
+	Users SASLUserStore
+	// ExternalIdentity is the authorization identity established by the
+	// transport, ie a TLS client certificate, empty when there is none
+	ExternalIdentity string
+}
+
+// SASLError is returned by a SASLConversation to end the exchange with a
+// specific result code
+type SASLError struct {
+	ResultCode int
+	Message    string
+}
+
+func (e *SASLError) Error() string {
+	return e.Message
+}
+
+func newSASLError(code int, format string, a ...interface{}) *SASLError {
+	return &SASLError{ResultCode: code, Message: fmt.Sprintf(format, a...)}
+}
+
+var (
+	saslMutex      sync.RWMutex
+	saslMechanisms = make(map[string]SASLMechanism)
+)
+
+// RegisterSASLMechanism makes a SASL mechanism available to the binds
+// handled by HandleSASLBind. A mechanism registered with the name of an
+// existing one replaces it.
+func RegisterSASLMechanism(m SASLMechanism) {
+	saslMutex.Lock()
+	defer saslMutex.Unlock()
+	saslMechanisms[strings.ToUpper(m.Name())] = m
+}
+
+// SASLMechanisms returns the sorted names of the registered mechanisms,
+// suitable for the supportedSASLMechanisms attribute of the root DSE
+func SASLMechanisms() []string {
+	saslMutex.RLock()
+	defer saslMutex.RUnlock()
+	names := make([]string, 0, len(saslMechanisms))
+	for name := range saslMechanisms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func getSASLMechanism(name string) (SASLMechanism, bool) {
+	saslMutex.RLock()
+	defer saslMutex.RUnlock()
+	m, ok := saslMechanisms[strings.ToUpper(name)]
+	return m, ok
+}
+
+func init() {
+	RegisterSASLMechanism(saslPlain{})
+	RegisterSASLMechanism(saslExternal{})
+	RegisterSASLMechanism(saslCramMD5{})
+	RegisterSASLMechanism(saslScramSHA256{})
+}
+
+// saslState is the SASL exchange in progress on a connection
+type saslState struct {
+	mechanism    string
+	conversation SASLConversation
+}
+
+// HandleSASLBind runs one step of a SASL bind. The exchange is kept on the
+// connection while the mechanism needs more round trips and the
+// authorization identity is recorded on the session once it succeeds.
+func HandleSASLBind(w ResponseWriter, m *Message, users SASLUserStore) {
+	mechanism, credentials, err := getSASLCredentials(m.GetBindRequest())
+	if err != nil {
+		m.Client.client.log.Debug("invalid sasl credentials", log.Ctx{"error": err})
+		res := NewBindResponse(LDAPResultProtocolError)
+		res.SetDiagnosticMessage("invalid SASL credentials")
+		w.Write(res)
+		return
+	}
+
+	state := m.Client.takeSASLState()
+	if state == nil || !strings.EqualFold(state.mechanism, mechanism) {
+		mech, ok := getSASLMechanism(mechanism)
+		if !ok {
+			res := NewBindResponse(LDAPResultAuthMethodNotSupported)
+			res.SetDiagnosticMessage(fmt.Sprintf("SASL mechanism %q not supported", mechanism))
+			w.Write(res)
+			return
+		}
+		state = &saslState{
+			mechanism: mechanism,
+			conversation: mech.Start(SASLContext{
+				Users:            users,
+				ExternalIdentity: m.Client.externalIdentity(),
+			}),
+		}
+	}
+
+	challenge, done, err := state.conversation.Next(credentials)
+	if err != nil {
+		code := LDAPResultInvalidCredentials
+		if e, ok := err.(*SASLError); ok {
+			code = e.ResultCode
+		}
+		m.Client.client.log.Info("SASL bind failed", log.Ctx{"mechanism": mechanism, "error": err})
+		res := NewBindResponse(code)
+		res.SetDiagnosticMessage(err.Error())
+		w.Write(res)
+		return
+	}
+
+	if !done {
+		m.Client.setSASLState(state)
+		w.Write(NewSASLBindResponse(LDAPResultSaslBindInProgress, challenge))
+		return
+	}
+
+	m.Client.bindSASL(state.mechanism, state.conversation.AuthzID())
+	m.Client.client.log.Debug("SASL bind succeeded", log.Ctx{"mechanism": mechanism, "authzid": state.conversation.AuthzID()})
+	w.Write(NewSASLBindResponse(LDAPResultSuccess, challenge))
+}
+
+// getSASLCredentials returns the mechanism and the credentials of a sasl
+// BindRequest, the credentials are nil when absent
+//
+//	SaslCredentials ::= SEQUENCE {
+//	        mechanism               LDAPString,
+//	        credentials             OCTET STRING OPTIONAL }
+func getSASLCredentials(r ldap.BindRequest) (string, []byte, error) {
+	op, err := encodeProtocolOp(r)
+	if err != nil {
+		return "", nil, err
+	}
+	elements, err := ber.DecodeAll(op.Content)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(elements) != 3 || elements[2].Tag != ber.ClassContext|ber.Constructed|ldap.TagAuthenticationChoiceSaslCredentials {
+		return "", nil, fmt.Errorf("not a sasl bind request")
+	}
+	sasl, err := ber.DecodeAll(elements[2].Content)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(sasl) == 0 || len(sasl) > 2 || sasl[0].Tag != ber.TagOctetString {
+		return "", nil, fmt.Errorf("invalid sasl credentials")
+	}
+	var credentials []byte
+	if len(sasl) == 2 {
+		if sasl[1].Tag != ber.TagOctetString {
+			return "", nil, fmt.Errorf("invalid sasl credentials")
+		}
+		credentials = sasl[1].Content
+	}
+	return string(sasl[0].Content), credentials, nil
+}
+
+// matchPassword returns true when password matches one of the stored
+// passwords
+func matchPassword(passwords [][]byte, password []byte) bool {
+	for _, p := range passwords {
+		if CheckPassword(p, password) {
+			return true
+		}
+	}
+	return false
+}
+
+// cleartextPassword returns the first password which is not hashed, the
+// challenge-response mechanisms can not work with hashed passwords
+func cleartextPassword(passwords [][]byte) ([]byte, bool) {
+	for _, p := range passwords {
+		if len(p) > 0 && p[0] != '{' {
+			return p, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,79 @@
+package ldap
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// saslCramMD5 implements the CRAM-MD5 mechanism, it needs the user
+// password to be stored in cleartext
+// @see RFC https://tools.ietf.org/html/rfc2195
+type saslCramMD5 struct{}
+
+func (saslCramMD5) Name() string {
+	return "CRAM-MD5"
+}
+
+func (saslCramMD5) Start(ctx SASLContext) SASLConversation {
+	return &saslCramMD5Conversation{users: ctx.Users}
+}
+
+type saslCramMD5Conversation struct {
+	users     SASLUserStore
+	challenge string
+	authzID   string
+}
+
+// Next sends the challenge on the first step and verifies the client
+// response on the second one
+//
+//	response = username SP hex(HMAC-MD5(password, challenge))
+func (c *saslCramMD5Conversation) Next(credentials []byte) ([]byte, bool, error) {
+	if c.challenge == "" {
+		if len(credentials) > 0 {
+			return nil, false, newSASLError(LDAPResultProtocolError, "CRAM-MD5 has no initial response")
+		}
+		hostname, _ := os.Hostname()
+		n, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+		c.challenge = fmt.Sprintf("<%d.%d@%s>", n, time.Now().Unix(), hostname)
+		return []byte(c.challenge), false, nil
+	}
+
+	i := strings.LastIndex(string(credentials), " ")
+	if i < 1 {
+		return nil, false, newSASLError(LDAPResultInvalidCredentials, "malformed CRAM-MD5 response")
+	}
+	username, digest := string(credentials[:i]), string(credentials[i+1:])
+
+	if c.users == nil {
+		return nil, false, newSASLError(LDAPResultInvalidCredentials, "invalid credentials")
+	}
+	dn, passwords, ok := c.users.LookupUser(username)
+	if !ok {
+		return nil, false, newSASLError(LDAPResultInvalidCredentials, "invalid credentials")
+	}
+	password, ok := cleartextPassword(passwords)
+	if !ok {
+		return nil, false, newSASLError(LDAPResultInappropriateAuthentication, "no cleartext password available for CRAM-MD5")
+	}
+
+	mac := hmac.New(md5.New, password)
+	mac.Write([]byte(c.challenge))
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(digest))) {
+		return nil, false, newSASLError(LDAPResultInvalidCredentials, "invalid credentials")
+	}
+	c.authzID = "dn:" + dn
+	return nil, true, nil
+}
+
+func (c *saslCramMD5Conversation) AuthzID() string {
+	return c.authzID
+}
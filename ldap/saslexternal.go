@@ -0,0 +1,34 @@
+package ldap
+
+// saslExternal implements the EXTERNAL mechanism, the client is
+// authenticated by the transport, ie with a TLS client certificate or the
+// credentials of a Unix domain socket peer
+// @see RFC https://tools.ietf.org/html/rfc4422#appendix-A
+type saslExternal struct{}
+
+func (saslExternal) Name() string {
+	return "EXTERNAL"
+}
+
+func (saslExternal) Start(ctx SASLContext) SASLConversation {
+	return &saslExternalConversation{identity: ctx.ExternalIdentity}
+}
+
+type saslExternalConversation struct {
+	identity string
+}
+
+// Next accepts an empty authorization identity or the external identity
+func (e *saslExternalConversation) Next(credentials []byte) ([]byte, bool, error) {
+	if e.identity == "" {
+		return nil, false, newSASLError(LDAPResultInappropriateAuthentication, "no external identity established")
+	}
+	if len(credentials) > 0 && string(credentials) != e.identity {
+		return nil, false, newSASLError(LDAPResultInsufficientAccessRights, "authorization identity not allowed")
+	}
+	return nil, true, nil
+}
+
+func (e *saslExternalConversation) AuthzID() string {
+	return e.identity
+}
@@ -0,0 +1,51 @@
+package ldap
+
+import "bytes"
+
+// saslPlain implements the PLAIN mechanism
+// @see RFC https://tools.ietf.org/html/rfc4616
+type saslPlain struct{}
+
+func (saslPlain) Name() string {
+	return "PLAIN"
+}
+
+func (saslPlain) Start(ctx SASLContext) SASLConversation {
+	return &saslPlainConversation{users: ctx.Users}
+}
+
+type saslPlainConversation struct {
+	users   SASLUserStore
+	authzID string
+}
+
+// Next verifies the single message of the exchange
+//
+//	message   = [authzid] UTF8NUL authcid UTF8NUL passwd
+func (p *saslPlainConversation) Next(credentials []byte) ([]byte, bool, error) {
+	parts := bytes.Split(credentials, []byte{0})
+	if len(parts) != 3 || len(parts[1]) == 0 || len(parts[2]) == 0 {
+		return nil, false, newSASLError(LDAPResultInvalidCredentials, "malformed PLAIN message")
+	}
+	authzid, authcid, password := string(parts[0]), string(parts[1]), parts[2]
+
+	if p.users == nil {
+		return nil, false, newSASLError(LDAPResultInvalidCredentials, "invalid credentials")
+	}
+	dn, passwords, ok := p.users.LookupUser(authcid)
+	if !ok || !matchPassword(passwords, password) {
+		return nil, false, newSASLError(LDAPResultInvalidCredentials, "invalid credentials")
+	}
+
+	// proxy authorization is not supported, the authorization identity
+	// must be the authenticated user
+	if authzid != "" && authzid != authcid && authzid != "u:"+authcid && authzid != "dn:"+dn {
+		return nil, false, newSASLError(LDAPResultInsufficientAccessRights, "authorization identity not allowed")
+	}
+	p.authzID = "dn:" + dn
+	return nil, true, nil
+}
+
+func (p *saslPlainConversation) AuthzID() string {
+	return p.authzID
+}
@@ -0,0 +1,196 @@
+package ldap
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"strconv"
+	"strings"
+)
+
+// scramIterations is the PBKDF2 iteration count sent to the clients
+const scramIterations = 4096
+
+// saslScramSHA256 implements the SCRAM-SHA-256 mechanism without channel
+// binding, it needs the user password to be stored in cleartext
+// @see RFC https://tools.ietf.org/html/rfc5802
+// @see RFC https://tools.ietf.org/html/rfc7677
+type saslScramSHA256 struct{}
+
+func (saslScramSHA256) Name() string {
+	return "SCRAM-SHA-256"
+}
+
+func (saslScramSHA256) Start(ctx SASLContext) SASLConversation {
+	return &saslScramConversation{users: ctx.Users}
+}
+
+type saslScramConversation struct {
+	users           SASLUserStore
+	step            int
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	saltedPassword  []byte
+	dn              string
+	authzID         string
+}
+
+func (s *saslScramConversation) Next(credentials []byte) ([]byte, bool, error) {
+	s.step++
+	switch s.step {
+	case 1:
+		return s.clientFirst(string(credentials))
+	case 2:
+		return s.clientFinal(string(credentials))
+	}
+	return nil, false, newSASLError(LDAPResultProtocolError, "unexpected SCRAM message")
+}
+
+// clientFirst handles the client-first-message and returns the
+// server-first-message
+//
+//	client-first-message = gs2-header client-first-message-bare
+//	gs2-header           = gs2-cbind-flag "," [ authzid ] ","
+//	client-first-message-bare = "n=" saslname ",r=" c-nonce [",x"]
+//	server-first-message = "r=" c-nonce s-nonce ",s=" salt ",i=" iteration-count
+func (s *saslScramConversation) clientFirst(msg string) ([]byte, bool, error) {
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return nil, false, newSASLError(LDAPResultInvalidCredentials, "malformed SCRAM client-first-message")
+	}
+	switch {
+	case parts[0] == "n" || parts[0] == "y":
+	case strings.HasPrefix(parts[0], "p="):
+		return nil, false, newSASLError(LDAPResultInappropriateAuthentication, "SCRAM channel binding not supported")
+	default:
+		return nil, false, newSASLError(LDAPResultInvalidCredentials, "malformed SCRAM gs2-header")
+	}
+	authzid := ""
+	if parts[1] != "" {
+		if !strings.HasPrefix(parts[1], "a=") {
+			return nil, false, newSASLError(LDAPResultInvalidCredentials, "malformed SCRAM gs2-header")
+		}
+		authzid = scramDecodeName(parts[1][2:])
+	}
+	s.gs2Header = parts[0] + "," + parts[1] + ","
+	s.clientFirstBare = parts[2]
+
+	attrs := scramAttributes(s.clientFirstBare)
+	username, cnonce := scramDecodeName(attrs["n"]), attrs["r"]
+	if username == "" || cnonce == "" {
+		return nil, false, newSASLError(LDAPResultInvalidCredentials, "malformed SCRAM client-first-message")
+	}
+
+	if s.users == nil {
+		return nil, false, newSASLError(LDAPResultInvalidCredentials, "invalid credentials")
+	}
+	dn, passwords, ok := s.users.LookupUser(username)
+	if !ok {
+		return nil, false, newSASLError(LDAPResultInvalidCredentials, "invalid credentials")
+	}
+	password, ok := cleartextPassword(passwords)
+	if !ok {
+		return nil, false, newSASLError(LDAPResultInappropriateAuthentication, "no cleartext password available for SCRAM-SHA-256")
+	}
+	if authzid != "" && authzid != username && authzid != "u:"+username && authzid != "dn:"+dn {
+		return nil, false, newSASLError(LDAPResultInsufficientAccessRights, "authorization identity not allowed")
+	}
+	s.dn = dn
+
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	snonce := make([]byte, 18)
+	rand.Read(snonce)
+	s.nonce = cnonce + base64.RawStdEncoding.EncodeToString(snonce)
+	s.saltedPassword = pbkdf2SHA256(password, salt, scramIterations)
+	s.serverFirst = "r=" + s.nonce + ",s=" + base64.StdEncoding.EncodeToString(salt) + ",i=" + strconv.Itoa(scramIterations)
+	return []byte(s.serverFirst), false, nil
+}
+
+// clientFinal verifies the client-final-message and returns the
+// server-final-message
+//
+//	client-final-message = "c=" base64(gs2-header) ",r=" nonce ",p=" base64(ClientProof)
+//	server-final-message = "v=" base64(ServerSignature)
+func (s *saslScramConversation) clientFinal(msg string) ([]byte, bool, error) {
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return nil, false, newSASLError(LDAPResultInvalidCredentials, "malformed SCRAM client-final-message")
+	}
+	withoutProof := msg[:i]
+	proof, err := base64.StdEncoding.DecodeString(msg[i+3:])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, false, newSASLError(LDAPResultInvalidCredentials, "malformed SCRAM client proof")
+	}
+
+	attrs := scramAttributes(withoutProof)
+	if attrs["c"] != base64.StdEncoding.EncodeToString([]byte(s.gs2Header)) {
+		return nil, false, newSASLError(LDAPResultInvalidCredentials, "SCRAM channel binding mismatch")
+	}
+	if attrs["r"] != s.nonce {
+		return nil, false, newSASLError(LDAPResultInvalidCredentials, "SCRAM nonce mismatch")
+	}
+
+	authMessage := []byte(s.clientFirstBare + "," + s.serverFirst + "," + withoutProof)
+	clientKey := hmacSHA256(s.saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	clientSignature := hmacSHA256(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientSignature[i]
+	}
+	if candidate := sha256.Sum256(proof); !hmac.Equal(candidate[:], storedKey[:]) {
+		return nil, false, newSASLError(LDAPResultInvalidCredentials, "invalid credentials")
+	}
+
+	serverKey := hmacSHA256(s.saltedPassword, []byte("Server Key"))
+	serverSignature := hmacSHA256(serverKey, authMessage)
+	s.authzID = "dn:" + s.dn
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), true, nil
+}
+
+func (s *saslScramConversation) AuthzID() string {
+	return s.authzID
+}
+
+// scramAttributes splits a SCRAM message in its attribute=value pairs
+func scramAttributes(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, part := range strings.Split(msg, ",") {
+		if len(part) >= 2 && part[1] == '=' {
+			attrs[part[:1]] = part[2:]
+		}
+	}
+	return attrs
+}
+
+// scramDecodeName decodes the "=2C" and "=3D" escapes of a saslname
+func scramDecodeName(name string) string {
+	return strings.NewReplacer("=2C", ",", "=3D", "=").Replace(name)
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// pbkdf2SHA256 derives a single block key, which is enough for the
+// SaltedPassword of SCRAM-SHA-256 since its length is the hash size
+// @see RFC https://tools.ietf.org/html/rfc2898#section-5.2
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	block := make([]byte, 4)
+	binary.BigEndian.PutUint32(block, 1)
+	u := hmacSHA256(password, append(append([]byte{}, salt...), block...))
+	result := append([]byte{}, u...)
+	for n := 1; n < iterations; n++ {
+		u = hmacSHA256(password, u)
+		for i := range result {
+			result[i] ^= u[i]
+		}
+	}
+	return result
+}
@@ -2,8 +2,12 @@ package ldap
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "gopkg.in/inconshreveable/log15.v2"
@@ -11,28 +15,71 @@ import (
 
 // Server is an LDAP server.
 type Server struct {
+	busy         uint64 // requests answered with busy, first for 64-bit alignment
 	Listener     net.Listener
+	listenMutex  sync.Mutex     // guards Listener while a listener is set up
 	ReadTimeout  time.Duration  // optional read timeout
 	WriteTimeout time.Duration  // optional write timeout
 	wg           sync.WaitGroup // group of goroutines (1 by client)
 	chDone       chan bool      // Channel Done, value => shutdown
+	ctx          context.Context
+	stop         context.CancelFunc // cancels ctx, the requests in progress are canceled
+	clients      int32              // number of accepted connections
+	connections  int32              // number of open connections
+	running      int32              // number of requests in progress
+
+	// MaxRequestsPerClient and MaxRequests limit the operations in
+	// progress on a connection and on the whole server, the requests
+	// beyond are answered with busy. Zero means no limit.
+	MaxRequestsPerClient int
+	MaxRequests          int
+
+	// MaxPDUSize and MaxPDUSizeAnonymous limit the size of the messages
+	// read from bound and anonymous clients, the connection is closed with
+	// a protocol error beyond. Zero means the default size, a negative size
+	// disables the limit.
+	MaxPDUSize          int
+	MaxPDUSizeAnonymous int
+
+	// TLSConfig is used by ListenAndServeTLS and StartTLS, see LoadTLS
+	TLSConfig *tls.Config
 
 	// OnNewConnection, if non-nil, is called on new connections.
 	// If it returns non-nil, the connection is closed.
 	OnNewConnection func(c net.Conn) error
 
+	// Metrics records the activity of the server, see ListenAndServeMetrics.
+	// Backends can register their own metrics in it.
+	Metrics       *Metrics
+	bytesReceived *Counter
+	bytesSent     *Counter
+
+	// AccessLog, if non-nil, receives one line per operation
+	AccessLog *AccessLog
+
 	// Handler handles ldap message received from client
 	// it SHOULD "implement" RequestHandler interface
 	Handler Handler
 	log     log.Logger
 }
 
+// DefaultMaxPDUSize and DefaultMaxPDUSizeAnonymous are the default size
+// limits of the messages read from bound and anonymous clients
+const (
+	DefaultMaxPDUSize          = 4 << 20
+	DefaultMaxPDUSizeAnonymous = 256 << 10
+)
+
 //NewServer return a LDAP Server
 func NewServer(logger log.Logger) *Server {
-	return &Server{
-		chDone: make(chan bool),
-		log:    logger.New(log.Ctx{"type": "ldap"}),
+	s := &Server{
+		chDone:  make(chan bool),
+		log:     logger.New(log.Ctx{"type": "ldap"}),
+		Metrics: NewMetrics(),
 	}
+	s.ctx, s.stop = context.WithCancel(context.Background())
+	s.registerMetrics()
+	return s
 }
 
 // Handle registers the handler for the server.
@@ -53,40 +100,105 @@ func (s *Server) ListenAndServe(addr string, options ...func(*Server)) error {
 		addr = ":389"
 	}
 
-	var e error
-	s.Listener, e = net.Listen("tcp", addr)
+	ln, e := net.Listen("tcp", addr)
 	if e != nil {
 		return e
 	}
 	s.log.Debug("Listening", log.Ctx{"addr": addr})
 
+	return s.serve(s.setListener(ln, options, nil))
+}
+
+// ListenAndServeTLS listens on the TCP network address addr for LDAPS
+// connections, TLS is negotiated before any LDAP message is exchanged. If
+// addr is blank, ":636" is used. The certificate files are loaded with
+// LoadTLS when certFile is not empty, otherwise the TLSConfig of the server
+// is used.
+func (s *Server) ListenAndServeTLS(addr string, certFile, keyFile, caFile string, options ...func(*Server)) error {
+
+	if addr == "" {
+		addr = ":636"
+	}
+
+	if certFile != "" {
+		if err := s.LoadTLS(TLSFiles{CertFile: certFile, KeyFile: keyFile, CAFile: caFile}); err != nil {
+			return err
+		}
+	}
+	if s.TLSConfig == nil {
+		return errors.New("ldap: ListenAndServeTLS without TLS configuration")
+	}
+
+	ln, e := net.Listen("tcp", addr)
+	if e != nil {
+		return e
+	}
+	s.log.Debug("Listening TLS", log.Ctx{"addr": addr})
+
+	// the options see the TCP listener, ie a PROXY protocol header comes
+	// before the TLS handshake
+	return s.serve(s.setListener(ln, options, func(ln net.Listener) net.Listener {
+		return tls.NewListener(ln, s.TLSConfig)
+	}))
+}
+
+// setListener makes ln the Listener of the server, applies the options to
+// it and then wraps it when wrap is not nil. The listeners started
+// concurrently are set up one at a time.
+func (s *Server) setListener(ln net.Listener, options []func(*Server), wrap func(net.Listener) net.Listener) net.Listener {
+	s.listenMutex.Lock()
+	defer s.listenMutex.Unlock()
+	s.Listener = ln
 	for _, option := range options {
 		option(s)
 	}
-
-	return s.serve()
+	if wrap != nil {
+		s.Listener = wrap(s.Listener)
+	}
+	return s.Listener
 }
 
+// acceptRetryDelay is how long the server waits before accepting again
+// after a temporary error
+const acceptRetryDelay = 50 * time.Millisecond
+
 // Handle requests messages on the ln listener
-func (s *Server) serve() error {
-	defer s.Listener.Close()
+func (s *Server) serve(ln net.Listener) error {
+	defer ln.Close()
 
 	if s.Handler == nil {
 		s.log.Crit("No LDAP Request Handler defined")
 	}
 
-	i := 0
-
 	for {
 		select {
 		case <-s.chDone:
 			s.log.Debug("Stopping server")
-			s.Listener.Close()
+			ln.Close()
 			return nil
 		default:
 		}
 
-		rw, err := s.Listener.Accept()
+		rw, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-s.chDone:
+				s.log.Debug("Stopping server")
+				return nil
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			// ie too many open files, accepting again may succeed later
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				s.log.Info("accept error", log.Ctx{"error": err})
+				time.Sleep(acceptRetryDelay)
+				continue
+			}
+			s.log.Info("listener closed", log.Ctx{"error": err})
+			return err
+		}
 
 		if s.ReadTimeout != 0 {
 			rw.SetReadDeadline(time.Now().Add(s.ReadTimeout))
@@ -94,12 +206,6 @@ func (s *Server) serve() error {
 		if s.WriteTimeout != 0 {
 			rw.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
 		}
-		if nil != err {
-			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
-				continue
-			}
-			s.log.Debug("error", err)
-		}
 
 		cli, err := s.newClient(rw)
 
@@ -107,11 +213,10 @@ func (s *Server) serve() error {
 			continue
 		}
 
-		i = i + 1
-		cli.Numero = i
+		cli.Numero = int(atomic.AddInt32(&s.clients, 1))
 		cli.log = s.log.New(log.Ctx{"clientid": cli.Numero})
-		s.log.Debug("Connection client accepted", log.Ctx{"clientid": cli.Numero, "addr": cli.rwc.RemoteAddr().String()})
 		s.wg.Add(1)
+		atomic.AddInt32(&s.connections, 1)
 		go cli.serve()
 	}
 
@@ -127,6 +232,14 @@ func (s *Server) newClient(rwc net.Conn) (c *client, err error) {
 		br:  bufio.NewReader(rwc),
 		bw:  bufio.NewWriter(rwc),
 	}
+	c.session = newSession(c)
+	if conn, ok := rwc.(*net.UnixConn); ok {
+		peer, err := peerCredentials(conn)
+		if err != nil {
+			s.log.Info("unable to read the peer credentials", log.Ctx{"error": err})
+		}
+		c.session.peer = peer
+	}
 	return c, nil
 }
 
@@ -142,7 +255,22 @@ func (s *Server) newClient(rwc net.Conn) (c *client, err error) {
 // In either case, when the LDAP session is terminated.
 func (s *Server) Stop() {
 	close(s.chDone)
+	s.stop()
 	s.log.Debug("gracefully closing client connections...")
 	s.wg.Wait()
 	s.log.Debug("all clients connection closed")
 }
+
+// maxPDUSize returns the size limit of the messages read from a client
+func (s *Server) maxPDUSize(anonymous bool) int {
+	if anonymous {
+		if s.MaxPDUSizeAnonymous != 0 {
+			return s.MaxPDUSizeAnonymous
+		}
+		return DefaultMaxPDUSizeAnonymous
+	}
+	if s.MaxPDUSize != 0 {
+		return s.MaxPDUSize
+	}
+	return DefaultMaxPDUSize
+}
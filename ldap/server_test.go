@@ -0,0 +1,167 @@
+package ldap
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jsimonetti/ldapserv/internal/ber"
+	ldap "github.com/lor00x/goldap/message"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// newTestServer returns a server handling the requests with h, its logs
+// are discarded
+func newTestServer(h HandlerFunc) *Server {
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	s := NewServer(logger)
+	s.Handle(h)
+	return s
+}
+
+// serveTCP serves s on a local TCP port, with the listener options, until
+// the end of the test and returns its address
+func serveTCP(t *testing.T, s *Server, options ...func(*Server)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.serve(s.setListener(ln, options, nil))
+	t.Cleanup(func() { stopTestServer(t, s) })
+	return ln.Addr().String()
+}
+
+// stopTestServer stops s and closes its listener once the connections of
+// the test clients are closed. It fails the test when a connection is left
+// open, ie leaked by the server. Stopping the server while a client is
+// closing is racy, the notice of disconnection may be queued on the closed
+// connection.
+func stopTestServer(t *testing.T, s *Server) {
+	for deadline := time.Now().Add(5 * time.Second); s.Stats().Connections > 0; {
+		if time.Now().After(deadline) {
+			t.Errorf("connections left open: %d", s.Stats().Connections)
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Stop()
+	s.listenMutex.Lock()
+	defer s.listenMutex.Unlock()
+	if s.Listener != nil {
+		s.Listener.Close()
+	}
+}
+
+// testConn is the connection of a test client
+type testConn struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func dialTest(t *testing.T, network, addr string) *testConn {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t: t, conn: conn, br: bufio.NewReader(conn)}
+}
+
+// search sends a search of the entry base
+func (c *testConn) search(messageID int, base string) {
+	op := ber.Encode(ber.ClassApplication|ber.Constructed|ldap.TagSearchRequest,
+		ber.OctetString([]byte(base)),
+		ber.Enumerated(SearchRequestScopeBaseObject),
+		ber.Enumerated(0), // derefAliases
+		ber.Integer(0),    // sizeLimit
+		ber.Integer(0),    // timeLimit
+		ber.Boolean(false),
+		ber.Encode(ber.ClassContext|ldap.TagFilterPresent, []byte("objectClass")),
+		ber.Sequence(), // attributes
+	)
+	if _, err := c.conn.Write(ber.Sequence(ber.Integer(int64(messageID)), op)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// abandon sends the abandon of the request target
+func (c *testConn) abandon(messageID, target int) {
+	op := ber.Encode(ber.ClassApplication|ldap.TagAbandonRequest, ber.IntegerContent(int64(target)))
+	if _, err := c.conn.Write(ber.Sequence(ber.Integer(int64(messageID)), op)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// read returns the next message sent by the server
+func (c *testConn) read() ldap.LDAPMessage {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	packet, err := readMessagePacket(c.br, func() int { return 0 })
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	m, err := packet.readMessage()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return m
+}
+
+// readResult reads a response and returns its message ID and result code
+func (c *testConn) readResult() (int, int) {
+	m := c.read()
+	code, ok := ResultCode(m.ProtocolOp())
+	if !ok {
+		c.t.Fatalf("unexpected %s response", m.ProtocolOpName())
+	}
+	return m.MessageID().Int(), code
+}
+
+// readNotice reads a notice of disconnection and returns its result code
+func (c *testConn) readNotice() int {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	packet, err := readMessagePacket(c.br, func() int { return 0 })
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	// goldap has no getter for the name of an extended response
+	elements, err := ber.DecodeSequence(packet.bytes)
+	if err != nil || len(elements) < 2 || elements[1].Tag != ber.ClassApplication|ber.Constructed|ldap.TagExtendedResponse {
+		c.t.Fatalf("got %s, want a notice of disconnection", packet.opName())
+	}
+	if id, _ := elements[0].Int(); id != 0 {
+		c.t.Errorf("got message %d, want a notice of disconnection", id)
+	}
+	components, err := ber.DecodeAll(elements[1].Content)
+	if err != nil || len(components) < 3 {
+		c.t.Fatalf("invalid extended response: %v", err)
+	}
+	var name string
+	for _, e := range components[3:] {
+		if e.Tag == ber.ClassContext|10 {
+			name = string(e.Content)
+		}
+	}
+	if name != string(NoticeOfDisconnection) {
+		c.t.Errorf("got extended response %q, want a notice of disconnection", name)
+	}
+	code, _ := components[0].Int()
+	return int(code)
+}
+
+// expectClosed checks that the server closed the connection without
+// sending anything more
+func (c *testConn) expectClosed() {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := c.br.ReadByte()
+	if err == nil {
+		c.t.Fatalf("unexpected data %#x, want the connection closed", b)
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		c.t.Fatal("the connection is still open")
+	}
+}
@@ -0,0 +1,223 @@
+package ldap
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+
+	ldap "github.com/lor00x/goldap/message"
+)
+
+// Authentication methods of a Session
+const (
+	AuthMethodAnonymous = "anonymous"
+	AuthMethodSimple    = "simple"
+	AuthMethodSASL      = "sasl"
+)
+
+// Session is the state of a client connection shared by all the requests
+// received on it. It holds the identity established by the last bind and a
+// key/value store the handlers can use to keep their own per connection
+// state.
+type Session struct {
+	client *client
+	peer   *PeerCred
+
+	mutex         sync.RWMutex
+	bindDN        string
+	authMethod    string
+	saslMechanism string
+	authzID       string
+	sasl          *saslState
+	values        map[string]interface{}
+}
+
+func newSession(c *client) *Session {
+	return &Session{
+		client:     c,
+		authMethod: AuthMethodAnonymous,
+		values:     make(map[string]interface{}),
+	}
+}
+
+// ID returns the connection number, unique for the server lifetime
+func (s *Session) ID() int {
+	return s.client.Numero
+}
+
+// RemoteAddr returns the network address of the client
+func (s *Session) RemoteAddr() net.Addr {
+	return s.client.GetConn().RemoteAddr()
+}
+
+// Addr returns the network address of the client
+//
+// Deprecated: use RemoteAddr
+func (s *Session) Addr() net.Addr {
+	return s.RemoteAddr()
+}
+
+// TLS returns the state of the TLS layer, nil when the connection is not
+// protected by TLS
+func (s *Session) TLS() *tls.ConnectionState {
+	if conn, ok := s.client.GetConn().(*tls.Conn); ok {
+		state := conn.ConnectionState()
+		return &state
+	}
+	return nil
+}
+
+// PeerCred returns the credentials of the peer process, nil when the
+// client is not connected through a Unix domain socket
+func (s *Session) PeerCred() *PeerCred {
+	return s.peer
+}
+
+// BindDN returns the DN the connection is bound as, empty when anonymous
+func (s *Session) BindDN() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.bindDN
+}
+
+// AuthMethod returns the method used by the last successful bind, one of
+// AuthMethodAnonymous, AuthMethodSimple or AuthMethodSASL
+func (s *Session) AuthMethod() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.authMethod
+}
+
+// SASLMechanism returns the mechanism used by the last successful SASL
+// bind, empty for the other methods
+func (s *Session) SASLMechanism() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.saslMechanism
+}
+
+// AuthzID returns the authorization identity of the connection, ie
+// "dn:cn=admin,dc=org", empty when anonymous
+func (s *Session) AuthzID() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.authzID
+}
+
+// IsAnonymous returns true until a bind succeeds
+func (s *Session) IsAnonymous() bool {
+	return s.AuthMethod() == AuthMethodAnonymous
+}
+
+// Get returns the value stored under key
+func (s *Session) Get(key string) (interface{}, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+// Set stores a value under key for the lifetime of the connection
+func (s *Session) Set(key string, value interface{}) {
+	s.mutex.Lock()
+	s.values[key] = value
+	s.mutex.Unlock()
+}
+
+// Delete removes the value stored under key
+func (s *Session) Delete(key string) {
+	s.mutex.Lock()
+	delete(s.values, key)
+	s.mutex.Unlock()
+}
+
+// GetMessageByID returns the request in progress with this message ID
+func (s *Session) GetMessageByID(messageID int) (*Message, bool) {
+	return s.client.GetMessageByID(messageID)
+}
+
+// GetConn returns the connection to the client
+func (s *Session) GetConn() net.Conn {
+	return s.client.GetConn()
+}
+
+// dropSASLState drops the SASL exchange in progress once TLS is
+// established, it was started on the previous transport. The bind identity
+// is kept.
+// @see RFC https://tools.ietf.org/html/rfc4513#section-3.1.5
+func (s *Session) dropSASLState() {
+	s.mutex.Lock()
+	s.sasl = nil
+	s.mutex.Unlock()
+}
+
+// resetBind drops the SASL exchange in progress and the bind identity, a
+// bind request always starts from an anonymous state
+// @see RFC https://tools.ietf.org/html/rfc4513#section-4
+func (s *Session) resetBind(r ldap.BindRequest) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.bindDN = ""
+	s.authMethod = AuthMethodAnonymous
+	s.saslMechanism = ""
+	s.authzID = ""
+	if r.AuthenticationChoice() != "sasl" {
+		s.sasl = nil
+	}
+}
+
+// bindSimple records the identity of a successful simple bind, a bind with
+// an empty name is an anonymous bind
+func (s *Session) bindSimple(dn string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.bindDN = dn
+	s.authMethod = AuthMethodSimple
+	s.authzID = "dn:" + dn
+	if dn == "" {
+		s.authMethod = AuthMethodAnonymous
+		s.authzID = ""
+	}
+}
+
+// bindSASL records the identity of a successful SASL bind
+func (s *Session) bindSASL(mechanism, authzID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.bindDN = ""
+	if strings.HasPrefix(authzID, "dn:") {
+		s.bindDN = authzID[3:]
+	}
+	s.authMethod = AuthMethodSASL
+	s.saslMechanism = strings.ToUpper(mechanism)
+	s.authzID = authzID
+}
+
+func (s *Session) takeSASLState() *saslState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state := s.sasl
+	s.sasl = nil
+	return state
+}
+
+func (s *Session) setSASLState(state *saslState) {
+	s.mutex.Lock()
+	s.sasl = state
+	s.mutex.Unlock()
+}
+
+// externalIdentity returns the identity established by the transport, a
+// verified TLS client certificate or the credentials of a local peer
+func (s *Session) externalIdentity() string {
+	if state := s.TLS(); state != nil {
+		if len(state.VerifiedChains) > 0 && len(state.PeerCertificates) > 0 {
+			return "dn:" + state.PeerCertificates[0].Subject.String()
+		}
+	}
+	if s.peer != nil {
+		return "dn:" + s.peer.DN()
+	}
+	return ""
+}
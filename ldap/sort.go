@@ -0,0 +1,203 @@
+package ldap
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/jsimonetti/ldapserv/filter"
+	"github.com/jsimonetti/ldapserv/internal/ber"
+)
+
+// Server Side Sorting controls
+// @see RFC https://tools.ietf.org/html/rfc2891
+const (
+	ControlTypeSortRequest  = "1.2.840.113556.1.4.473"
+	ControlTypeSortResponse = "1.2.840.113556.1.4.474"
+)
+
+// Ordering matching rules supported by SortEntries
+const (
+	MatchingRuleCaseIgnoreOrdering      = filter.MatchingRuleCaseIgnoreOrdering
+	MatchingRuleCaseExactOrdering       = filter.MatchingRuleCaseExactOrdering
+	MatchingRuleNumericStringOrdering   = filter.MatchingRuleNumericStringOrdering
+	MatchingRuleIntegerOrdering         = filter.MatchingRuleIntegerOrdering
+	MatchingRuleGeneralizedTimeOrdering = filter.MatchingRuleGeneralizedTimeOrdering
+)
+
+// Entry gives the shared search helpers access to the attributes of a
+// backend entry
+type Entry interface {
+	DN() string
+	AttributeValues(name string) []string
+}
+
+// SortKey is a key of the server side sort request control
+type SortKey struct {
+	AttributeType string
+	OrderingRule  string
+	Reverse       bool
+}
+
+// ParseSortControl decodes the value of a sort request control
+//
+//	SortKeyList ::= SEQUENCE OF SEQUENCE {
+//	        attributeType   AttributeDescription,
+//	        orderingRule    [0] MatchingRuleId OPTIONAL,
+//	        reverseOrder    [1] BOOLEAN DEFAULT FALSE }
+func ParseSortControl(c Control) ([]SortKey, error) {
+	list, err := ber.DecodeSequence(c.Value)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("empty sort key list")
+	}
+	keys := make([]SortKey, 0, len(list))
+	for _, item := range list {
+		if item.Tag != ber.TagSequence {
+			return nil, fmt.Errorf("invalid sort key")
+		}
+		elements, err := ber.DecodeAll(item.Content)
+		if err != nil {
+			return nil, err
+		}
+		if len(elements) == 0 || elements[0].Tag != ber.TagOctetString {
+			return nil, fmt.Errorf("invalid sort key attribute type")
+		}
+		key := SortKey{AttributeType: string(elements[0].Content)}
+		for _, e := range elements[1:] {
+			switch e.Tag {
+			case ber.ClassContext | 0:
+				key.OrderingRule = string(e.Content)
+			case ber.ClassContext | 1:
+				key.Reverse = e.Bool()
+			default:
+				return nil, fmt.Errorf("invalid sort key element %#x", e.Tag)
+			}
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// SortResult is the value of the sort response control
+type SortResult struct {
+	ResultCode    int
+	AttributeType string
+}
+
+// Control returns the sort response control to send to the client
+//
+//	SortResult ::= SEQUENCE {
+//	        sortResult  ENUMERATED,
+//	        attributeType [0] AttributeDescription OPTIONAL }
+func (s SortResult) Control() Control {
+	elements := [][]byte{ber.Enumerated(s.ResultCode)}
+	if s.AttributeType != "" {
+		elements = append(elements, ber.Encode(ber.ClassContext|0, []byte(s.AttributeType)))
+	}
+	return NewControl(ControlTypeSortResponse, false, ber.Sequence(elements...))
+}
+
+// SortEntries sorts the entries as requested by the sort control of m
+// and attaches the sort response control. It returns the result code of
+// the search: unavailableCriticalExtension when the entries can not be
+// sorted and the control is critical, success otherwise, in which case
+// the entries are left unsorted when sorting failed.
+func SortEntries(w ResponseWriter, m *Message, entries []Entry) int {
+	c, ok := m.GetControl(ControlTypeSortRequest)
+	if !ok {
+		return LDAPResultSuccess
+	}
+
+	result := sortEntries(c, entries)
+	w.AddControl(result.Control())
+	if result.ResultCode != LDAPResultSuccess && c.Criticality {
+		return LDAPResultUnavailableCriticalExtension
+	}
+	return LDAPResultSuccess
+}
+
+func sortEntries(c Control, entries []Entry) SortResult {
+	keys, err := ParseSortControl(c)
+	if err != nil {
+		return SortResult{ResultCode: LDAPResultProtocolError}
+	}
+
+	rules := make([]string, len(keys))
+	for i, key := range keys {
+		rule, ok := orderingRule(key)
+		if !ok {
+			return SortResult{ResultCode: LDAPResultInappropriateMatching, AttributeType: key.AttributeType}
+		}
+		rules[i] = rule
+	}
+
+	values := make([][]*string, len(entries))
+	for i, e := range entries {
+		values[i] = make([]*string, len(keys))
+		for k, key := range keys {
+			values[i][k] = sortValue(e, key, rules[k])
+		}
+	}
+
+	index := make([]int, len(entries))
+	for i := range index {
+		index[i] = i
+	}
+	sort.SliceStable(index, func(a, b int) bool {
+		va, vb := values[index[a]], values[index[b]]
+		for k, key := range keys {
+			var cmp int
+			switch {
+			// a missing value is larger than all the others, the
+			// entries without value are last, first in reverse order
+			// @see RFC https://tools.ietf.org/html/rfc2891#section-2.2
+			case va[k] == nil && vb[k] == nil:
+				continue
+			case va[k] == nil:
+				return key.Reverse
+			case vb[k] == nil:
+				return !key.Reverse
+			default:
+				cmp = filter.CompareOrdering(rules[k], *va[k], *vb[k])
+			}
+			if cmp == 0 {
+				continue
+			}
+			return cmp < 0 != key.Reverse
+		}
+		return false
+	})
+
+	sorted := make([]Entry, len(entries))
+	for i, j := range index {
+		sorted[i] = entries[j]
+	}
+	copy(entries, sorted)
+	return SortResult{ResultCode: LDAPResultSuccess}
+}
+
+// sortValue returns the value used to sort an entry: its smallest value
+// in ascending order and its largest value in reverse order
+func sortValue(e Entry, key SortKey, rule string) *string {
+	var selected *string
+	for _, v := range e.AttributeValues(key.AttributeType) {
+		v := v
+		if !filter.ValidOrderingValue(rule, v) {
+			continue
+		}
+		if selected == nil || filter.CompareOrdering(rule, v, *selected) < 0 != key.Reverse {
+			selected = &v
+		}
+	}
+	return selected
+}
+
+// orderingRule returns the ordering matching rule to use for the key
+func orderingRule(key SortKey) (string, bool) {
+	if key.OrderingRule == "" {
+		return filter.OrderingRule(key.AttributeType)
+	}
+	return filter.LookupOrderingRule(key.OrderingRule)
+}
@@ -0,0 +1,88 @@
+package ldap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync/atomic"
+
+	ldap "github.com/lor00x/goldap/message"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// startTLS negotiates TLS on the connection. It is called by the read loop
+// so no other message is read until the handshake is over. An error is
+// returned when the connection has to be closed.
+// @see RFC https://tools.ietf.org/html/rfc4511#section-4.14
+func (c *client) startTLS(message *ldap.LDAPMessage) error {
+	switch {
+	case c.srv.TLSConfig == nil:
+		return c.writeAndFlush(message, startTLSResponse(LDAPResultUnavailable, "TLS is not available"))
+	case c.session.TLS() != nil:
+		return c.writeAndFlush(message, startTLSResponse(LDAPResultOperationsError, "TLS is already established"))
+	case atomic.LoadInt32(&c.running) > 0:
+		return c.writeAndFlush(message, startTLSResponse(LDAPResultOperationsError, "operations are outstanding"))
+	}
+
+	// the response has to reach the client before the handshake starts
+	if err := c.writeAndFlush(message, startTLSResponse(LDAPResultSuccess, "")); err != nil {
+		return err
+	}
+
+	// the writer is held until the reader and writer use the TLS layer, a
+	// message sent meanwhile, ie a notice of disconnection, waits for it
+	c.connMutex.Lock()
+	defer c.connMutex.Unlock()
+
+	conn := tls.Server(&bufferedConn{Conn: c.rwc, r: c.br}, c.srv.TLSConfig)
+	if err := conn.Handshake(); err != nil {
+		// the success response is already sent, the connection is closed
+		// rather than answering a second time
+		c.log.Error("StartTLS handshake error", log.Ctx{"error": err})
+		return err
+	}
+
+	c.rwc = conn
+	c.br = bufio.NewReader(conn)
+	c.bw = bufio.NewWriter(conn)
+	c.session.dropSASLState()
+
+	state := conn.ConnectionState()
+	c.log.Debug("StartTLS OK", log.Ctx{"version": state.Version, "ciphersuite": state.CipherSuite})
+	return nil
+}
+
+// writeAndFlush writes a response to the request and waits until it is
+// flushed to the connection
+func (c *client) writeAndFlush(message *ldap.LDAPMessage, po ldap.ProtocolOp) error {
+	m := &outgoingMessage{
+		LDAPMessage: ldap.NewLDAPMessageWithProtocolOp(po),
+		written:     make(chan error, 1),
+	}
+	m.SetMessageID(message.MessageID().Int())
+	select {
+	case c.chanOut <- m:
+	case <-c.srv.chDone:
+		return errors.New("server is about to stop")
+	}
+	return <-m.written
+}
+
+func startTLSResponse(resultCode int, diagnosticMessage string) ldap.ExtendedResponse {
+	res := NewExtendedResponse(resultCode)
+	res.SetResponseName(NoticeOfStartTLS)
+	res.SetDiagnosticMessage(diagnosticMessage)
+	return res
+}
+
+// bufferedConn reads the bytes already buffered by the LDAP reader before
+// the connection, the TLS handshake may have started in them
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
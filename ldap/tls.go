@@ -0,0 +1,175 @@
+package ldap
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// TLSReloadInterval is how often the certificate files are checked for
+// changes
+var TLSReloadInterval = 10 * time.Second
+
+// TLSFiles are the PEM files of the server certificate and key, and of
+// the optional CA bundle used to verify the client certificates
+type TLSFiles struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+	// ClientAuth is the client certificate policy, it defaults to
+	// tls.VerifyClientCertIfGiven when CAFile is set
+	ClientAuth tls.ClientAuthType
+}
+
+// DefaultTLSConfig returns the TLS settings used by the LDAPS listener and
+// StartTLS: TLS 1.2 or later with forward secret AEAD cipher suites
+func DefaultTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		},
+		PreferServerCipherSuites: true,
+		CurvePreferences:         []tls.CurveID{tls.X25519, tls.CurveP256},
+	}
+}
+
+// LoadTLS loads the certificate files and sets the server TLSConfig used
+// by ListenAndServeTLS and StartTLS. The files are reloaded on SIGHUP and
+// when they change, the established connections are kept.
+func (s *Server) LoadTLS(files TLSFiles) error {
+	r := &tlsReloader{files: files, log: s.log}
+	if err := r.reload(); err != nil {
+		return err
+	}
+	s.TLSConfig = r.tlsConfig()
+	go r.watch(s.chDone)
+	return nil
+}
+
+// tlsReloader holds the TLS configuration built from the files and
+// replaces it when they change
+type tlsReloader struct {
+	files TLSFiles
+	log   log.Logger
+
+	mutex   sync.RWMutex
+	config  *tls.Config
+	modTime map[string]time.Time
+}
+
+// tlsConfig returns the configuration to use with tls.Server, it asks the
+// reloader for the current certificate on each handshake
+func (r *tlsReloader) tlsConfig() *tls.Config {
+	config := DefaultTLSConfig()
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		r.mutex.RLock()
+		defer r.mutex.RUnlock()
+		return r.config, nil
+	}
+	config.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		r.mutex.RLock()
+		defer r.mutex.RUnlock()
+		return &r.config.Certificates[0], nil
+	}
+	return config
+}
+
+// reload loads the files, the current configuration is kept when they
+// can not be loaded
+func (r *tlsReloader) reload() error {
+	modTime := make(map[string]time.Time)
+	for _, name := range []string{r.files.CertFile, r.files.KeyFile, r.files.CAFile} {
+		if name == "" {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		modTime[name] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.files.CertFile, r.files.KeyFile)
+	if err != nil {
+		return err
+	}
+	config := DefaultTLSConfig()
+	config.Certificates = []tls.Certificate{cert}
+
+	if r.files.CAFile != "" {
+		pem, err := ioutil.ReadFile(r.files.CAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no CA certificate found in %s", r.files.CAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if r.files.ClientAuth != tls.NoClientCert {
+		config.ClientAuth = r.files.ClientAuth
+	}
+
+	r.mutex.Lock()
+	r.config = config
+	r.modTime = modTime
+	r.mutex.Unlock()
+	return nil
+}
+
+// changed returns true when one of the files was modified since the last
+// reload
+func (r *tlsReloader) changed() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for name, modTime := range r.modTime {
+		info, err := os.Stat(name)
+		if err != nil || !info.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads the files on SIGHUP and when they change, until done is
+// closed
+func (r *tlsReloader) watch(done chan bool) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(TLSReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-hup:
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+		}
+		if err := r.reload(); err != nil {
+			r.log.Error("unable to reload the TLS certificates", log.Ctx{"error": err})
+			continue
+		}
+		r.log.Info("TLS certificates reloaded", log.Ctx{"cert": r.files.CertFile})
+	}
+}
@@ -0,0 +1,235 @@
+package ldap
+
+import (
+	"fmt"
+
+	"github.com/jsimonetti/ldapserv/filter"
+	"github.com/jsimonetti/ldapserv/internal/ber"
+)
+
+// Virtual List View controls
+// @see https://tools.ietf.org/html/draft-ietf-ldapext-ldapv3-vlv-09
+const (
+	ControlTypeVLVRequest  = "2.16.840.1.113730.3.4.9"
+	ControlTypeVLVResponse = "2.16.840.1.113730.3.4.10"
+)
+
+// VLVRequest is the value of a virtual list view request control. The
+// target is either an offset in the list (ByOffset) or the first entry
+// whose sort key is greater than or equal to GreaterThanOrEqual.
+type VLVRequest struct {
+	BeforeCount        int
+	AfterCount         int
+	ByOffset           bool
+	Offset             int
+	ContentCount       int
+	GreaterThanOrEqual string
+	ContextID          []byte
+}
+
+// ParseVLVControl decodes the value of a virtual list view request control
+//
+//	VirtualListViewRequest ::= SEQUENCE {
+//	        beforeCount    INTEGER (0..maxInt),
+//	        afterCount     INTEGER (0..maxInt),
+//	        target       CHOICE {
+//	                       byOffset        [0] SEQUENCE {
+//	                            offset          INTEGER (1 .. maxInt),
+//	                            contentCount    INTEGER (0 .. maxInt) },
+//	                       greaterThanOrEqual [1] AssertionValue },
+//	        contextID     OCTET STRING OPTIONAL }
+func ParseVLVControl(c Control) (VLVRequest, error) {
+	var v VLVRequest
+	elements, err := ber.DecodeSequence(c.Value)
+	if err != nil {
+		return v, err
+	}
+	if len(elements) < 3 || elements[0].Tag != ber.TagInteger || elements[1].Tag != ber.TagInteger {
+		return v, fmt.Errorf("invalid virtual list view control value")
+	}
+	before, err := elements[0].Int()
+	if err != nil {
+		return v, err
+	}
+	after, err := elements[1].Int()
+	if err != nil {
+		return v, err
+	}
+	if before < 0 || after < 0 || before > 1<<31-1 || after > 1<<31-1 {
+		return v, fmt.Errorf("invalid virtual list view before or after count")
+	}
+	v.BeforeCount, v.AfterCount = int(before), int(after)
+
+	switch elements[2].Tag {
+	case ber.ClassContext | ber.Constructed | 0:
+		offsets, err := ber.DecodeAll(elements[2].Content)
+		if err != nil {
+			return v, err
+		}
+		if len(offsets) != 2 || offsets[0].Tag != ber.TagInteger || offsets[1].Tag != ber.TagInteger {
+			return v, fmt.Errorf("invalid virtual list view byOffset target")
+		}
+		offset, err := offsets[0].Int()
+		if err != nil {
+			return v, err
+		}
+		count, err := offsets[1].Int()
+		if err != nil {
+			return v, err
+		}
+		if offset < 0 || count < 0 || offset > 1<<31-1 || count > 1<<31-1 {
+			return v, fmt.Errorf("invalid virtual list view offset or content count")
+		}
+		v.ByOffset = true
+		v.Offset, v.ContentCount = int(offset), int(count)
+	case ber.ClassContext | 1:
+		v.GreaterThanOrEqual = string(elements[2].Content)
+	default:
+		return v, fmt.Errorf("invalid virtual list view target %#x", elements[2].Tag)
+	}
+
+	if len(elements) > 3 {
+		if elements[3].Tag != ber.TagOctetString {
+			return v, fmt.Errorf("invalid virtual list view context id")
+		}
+		v.ContextID = elements[3].Content
+	}
+	return v, nil
+}
+
+// VLVResponse is the value of a virtual list view response control
+type VLVResponse struct {
+	TargetPosition int
+	ContentCount   int
+	ResultCode     int
+	ContextID      []byte
+}
+
+// Control returns the virtual list view response control to send to the
+// client
+//
+//	VirtualListViewResponse ::= SEQUENCE {
+//	        targetPosition    INTEGER (0 .. maxInt),
+//	        contentCount     INTEGER (0 .. maxInt),
+//	        virtualListViewResult ENUMERATED,
+//	        contextID     OCTET STRING OPTIONAL }
+func (v VLVResponse) Control() Control {
+	elements := [][]byte{
+		ber.Integer(int64(v.TargetPosition)),
+		ber.Integer(int64(v.ContentCount)),
+		ber.Enumerated(v.ResultCode),
+	}
+	if v.ContextID != nil {
+		elements = append(elements, ber.OctetString(v.ContextID))
+	}
+	return NewControl(ControlTypeVLVResponse, false, ber.Sequence(elements...))
+}
+
+// VirtualListView returns the window of the sorted entries requested by
+// the virtual list view control of m and attaches the response control.
+// When the view can not be built, the result code is returned with all the
+// entries if the control is not critical, without entries otherwise.
+func VirtualListView(w ResponseWriter, m *Message, entries []Entry) ([]Entry, int) {
+	c, ok := m.GetControl(ControlTypeVLVRequest)
+	if !ok {
+		return entries, LDAPResultSuccess
+	}
+
+	view, response := virtualListView(c, m, entries)
+	w.AddControl(response.Control())
+	if response.ResultCode != LDAPResultSuccess {
+		if c.Criticality {
+			return nil, response.ResultCode
+		}
+		return entries, LDAPResultSuccess
+	}
+	return view, LDAPResultSuccess
+}
+
+func virtualListView(c Control, m *Message, entries []Entry) ([]Entry, VLVResponse) {
+	response := VLVResponse{ContentCount: len(entries)}
+
+	request, err := ParseVLVControl(c)
+	if err != nil {
+		response.ResultCode = LDAPResultProtocolError
+		return nil, response
+	}
+	response.ContextID = request.ContextID
+
+	// the list is defined by the sort order of the entries
+	sc, ok := m.GetControl(ControlTypeSortRequest)
+	if !ok {
+		response.ResultCode = LDAPResultSortControlMissing
+		return nil, response
+	}
+
+	// target is the 1-based position of the target entry in the list, it
+	// is len(entries)+1 when the target is after the last entry
+	var target int
+	if request.ByOffset {
+		if request.Offset < 1 {
+			response.ResultCode = LDAPResultOffsetRangeError
+			return nil, response
+		}
+		target = request.Offset
+		// the client content count is an estimate, scale the offset to
+		// the real size of the list
+		if request.ContentCount > 0 && request.ContentCount != len(entries) {
+			if request.Offset >= request.ContentCount {
+				target = len(entries)
+			} else if request.ContentCount > 1 {
+				target = 1 + (request.Offset-1)*(len(entries)-1)/(request.ContentCount-1)
+			}
+		}
+		if target > len(entries) {
+			target = len(entries)
+		}
+	} else {
+		keys, err := ParseSortControl(sc)
+		if err != nil {
+			response.ResultCode = LDAPResultProtocolError
+			return nil, response
+		}
+		rule, ok := orderingRule(keys[0])
+		if !ok {
+			response.ResultCode = LDAPResultInappropriateMatching
+			return nil, response
+		}
+		target = len(entries) + 1
+		for i, e := range entries {
+			v := sortValue(e, keys[0], rule)
+			// entries without value are at the end of the list, at
+			// its start in reverse order, see sortEntries
+			if v == nil {
+				if keys[0].Reverse {
+					continue
+				}
+				target = i + 1
+				break
+			}
+			cmp := filter.CompareOrdering(rule, *v, request.GreaterThanOrEqual)
+			if (!keys[0].Reverse && cmp >= 0) || (keys[0].Reverse && cmp <= 0) {
+				target = i + 1
+				break
+			}
+		}
+	}
+
+	response.TargetPosition = target
+	if len(entries) == 0 {
+		return nil, response
+	}
+
+	first := target - request.BeforeCount
+	if first < 1 {
+		first = 1
+	}
+	last := target + request.AfterCount
+	if last > len(entries) {
+		last = len(entries)
+	}
+	if first > last {
+		return nil, response
+	}
+	return entries[first-1 : last], response
+}
@@ -0,0 +1,16 @@
+package ldap
+
+// HandleWhoAmI answers a "Who am I?" extended request with the
+// authorization identity of the session: "dn:<dn>" or "u:<userid>", an
+// empty value when the session is anonymous
+// @see RFC https://tools.ietf.org/html/rfc4532
+func HandleWhoAmI(w ResponseWriter, m *Message) {
+	r := m.GetExtendedRequest()
+	if r.RequestValue() != nil {
+		res := NewExtendedResponse(LDAPResultProtocolError)
+		res.SetDiagnosticMessage("Who am I? request must not have a value")
+		w.Write(res)
+		return
+	}
+	w.Write(NewExtendedResponseWithValue(LDAPResultSuccess, "", []byte(m.Client.AuthzID())))
+}
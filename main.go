@@ -5,6 +5,7 @@ import (
 	"math/rand"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -19,6 +20,21 @@ var debugflag bool
 var verboseflag bool
 var quietflag bool
 var helpflag bool
+var passwordscheme string
+var listenaddr string
+var ldapsaddr string
+var ldapipath string
+var proxynetworks string
+var metricsaddr string
+var accesslog string
+var accesslogformat string
+var tlscert string
+var tlskey string
+var tlsca string
+var maxrequests int
+var maxclientrequests int
+var maxpdusize int
+var maxpdusizeanonymous int
 
 var logger log.Logger
 
@@ -29,6 +45,21 @@ func init() {
 	flag.BoolVar(&verboseflag, "verbose", false, "show verbose logging")
 	flag.BoolVar(&quietflag, "quiet", false, "suppress logging")
 	flag.BoolVar(&helpflag, "help", false, "show usage")
+	flag.StringVar(&listenaddr, "listen", ":6389", "address to listen on for ldap")
+	flag.StringVar(&ldapsaddr, "ldaps", "", "address to listen on for ldaps, ie :6636")
+	flag.StringVar(&ldapipath, "ldapi", "", "unix socket to listen on for ldapi, ie /var/run/ldapserv.sock")
+	flag.StringVar(&proxynetworks, "proxyprotocol", "", "comma separated networks of the load balancers sending a PROXY protocol header")
+	flag.StringVar(&metricsaddr, "metrics", "", "address to serve Prometheus metrics on over HTTP, ie :9389")
+	flag.StringVar(&accesslog, "accesslog", "", "file to write the access log to, - for stdout")
+	flag.StringVar(&accesslogformat, "accesslogformat", ldap.AccessLogText, "format of the access log, text or json")
+	flag.StringVar(&tlscert, "tlscert", "", "PEM certificate file for ldaps and StartTLS")
+	flag.StringVar(&tlskey, "tlskey", "", "PEM private key file of the certificate")
+	flag.StringVar(&tlsca, "tlsca", "", "PEM CA bundle used to verify client certificates")
+	flag.IntVar(&maxrequests, "maxrequests", 100, "operations in progress on the server before answering busy, 0 for no limit")
+	flag.IntVar(&maxclientrequests, "maxclientrequests", 10, "operations in progress on a connection before answering busy, 0 for no limit")
+	flag.IntVar(&maxpdusize, "maxpdusize", ldap.DefaultMaxPDUSize, "largest message accepted from a bound client, in bytes")
+	flag.IntVar(&maxpdusizeanonymous, "maxpdusizeanonymous", ldap.DefaultMaxPDUSizeAnonymous, "largest message accepted before bind, in bytes")
+	flag.StringVar(&passwordscheme, "passwordscheme", ldap.PasswordSchemeSSHA, "scheme used to store changed passwords")
 }
 
 func main() {
@@ -51,9 +82,35 @@ func main() {
 		logger.SetHandler(log.LvlFilterHandler(log.LvlError, handler))
 	}
 
+	//Create a new LDAP Server
+	server := ldap.NewServer(logger)
+	server.MaxRequests = maxrequests
+	server.MaxRequestsPerClient = maxclientrequests
+	server.MaxPDUSize = maxpdusize
+	server.MaxPDUSizeAnonymous = maxpdusizeanonymous
+
+	// the access log is independent of the log level settings
+	switch accesslog {
+	case "":
+	case "-":
+		server.AccessLog = ldap.NewAccessLog(os.Stdout, accesslogformat)
+	default:
+		f, err := os.OpenFile(accesslog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+		if err != nil {
+			logger.Error("unable to open the access log", log.Ctx{"error": err})
+			os.Exit(1)
+		}
+		defer f.Close()
+		server.AccessLog = ldap.NewAccessLog(f, accesslogformat)
+	}
+
 	ldifstore := &ldif.LdifBackend{
 		Path: "./ldif",
 		Log:  logger.New(log.Ctx{"type": "backend", "backend": "ldif"}),
+
+		PasswordScheme: passwordscheme,
+		Admins:         []string{"cn=admin,dc=enterprise,dc=org"},
+		Metrics:        server.Metrics,
 	}
 
 	if err := ldifstore.Start(); err != nil {
@@ -61,26 +118,55 @@ func main() {
 		os.Exit(1)
 	}
 
-	//Create a new LDAP Server
-	server := ldap.NewServer(logger)
+	if tlscert != "" {
+		files := ldap.TLSFiles{CertFile: tlscert, KeyFile: tlskey, CAFile: tlsca}
+		if err := server.LoadTLS(files); err != nil {
+			logger.Error("error loading TLS certificates", log.Ctx{"error": err})
+			os.Exit(1)
+		}
+	}
 
 	fallback := &debug.DebugBackend{
 		Log: logger.New(log.Ctx{"type": "backend", "backend": "debug"}),
 	}
 
 	//Create routes bindings
-	routes := newRouter(fallback, logger)
+	routes := newRouter(fallback, logger, server.TLSConfig)
 
 	// backend specific routes
 	routes.Bind(ldifstore).BaseDn("dc=enterprise,dc=org").Label("Bind LDIF")
-	routes.Search(ldifstore).BaseDn("dc=enterprise,dc=org").Label("Search LDIF")
+	routes.Bind(ldifstore).AuthenticationChoice("sasl").Label("SASL Bind LDIF")
+	routes.Search(ldifstore).BaseDn("dc=enterprise,dc=org").
+		Controls(ldap.ControlTypePaging, ldap.ControlTypeSortRequest, ldap.ControlTypeVLVRequest).
+		Label("Search LDIF")
 	routes.Add(ldifstore).BaseDn("dc=enterprise,dc=org").Label("Add LDIF")
+	routes.ModifyDN(ldifstore).BaseDn("dc=enterprise,dc=org").Label("ModifyDN LDIF")
+	routes.Extended(ldifstore).RequestName(ldap.NoticeOfPasswordModify).Label("Password Modify LDIF")
 
 	//Attach routes to server
 	server.Handle(routes)
 
-	// listen on 3389 and serve
-	go server.ListenAndServe(":6389")
+	var options []func(*ldap.Server)
+	if proxynetworks != "" {
+		trusted, err := ldap.ParseNetworks(strings.Split(proxynetworks, ","))
+		if err != nil {
+			logger.Error("invalid PROXY protocol networks", log.Ctx{"error": err})
+			os.Exit(1)
+		}
+		options = append(options, ldap.ProxyProtocol(trusted))
+	}
+
+	// listen on 6389 and serve
+	go server.ListenAndServe(listenaddr, options...)
+	if ldapsaddr != "" {
+		go server.ListenAndServeTLS(ldapsaddr, "", "", "", options...)
+	}
+	if ldapipath != "" {
+		go server.ListenAndServeUnix(ldapipath)
+	}
+	if metricsaddr != "" {
+		go server.ListenAndServeMetrics(metricsaddr)
+	}
 
 	// When CTRL+C, SIGINT and SIGTERM signal occurs
 	// Then stop server gracefully
@@ -90,4 +176,7 @@ func main() {
 	close(ch)
 
 	server.Stop()
+
+	stats := server.Stats()
+	logger.Info("server stopped", log.Ctx{"accepted": stats.Accepted, "busy": stats.BusyResponses})
 }